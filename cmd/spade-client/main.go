@@ -6,11 +6,15 @@ import (
 	"filecoin-spade-client/pkg/client"
 	"filecoin-spade-client/pkg/config"
 	"filecoin-spade-client/pkg/log"
+	"filecoin-spade-client/pkg/schedule"
+	"filecoin-spade-client/pkg/state"
 	"fmt"
+	"github.com/dustin/go-humanize"
 	"github.com/urfave/cli/v2"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -42,12 +46,269 @@ func main() {
 					&cli.StringFlag{
 						Name:  "download-path",
 						Value: "/tmp/filecoin-spade-downloads",
-						Usage: "The location where the downloaded files should reside",
+						Usage: "The location where the downloaded files should reside, downloads are written to its staging directory until they are complete and verified",
+					},
+					&cli.StringSliceFlag{
+						Name:  "download-root",
+						Usage: "Directory to spread the downloads over instead of the download path, as Path or Path=Capacity to limit the bytes of downloads it holds (e.g. /mnt/disk1=8TiB). Can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "download-placement",
+						Value: "free-space",
+						Usage: "How to pick the download root for a deal: free-space (the most available space) or round-robin",
+					},
+					&cli.StringFlag{
+						Name:  "download-space-reserve",
+						Value: "10GiB",
+						Usage: "Disk space to keep free in each download root, on top of the space needed for reserved and downloading pieces",
+					},
+					&cli.StringFlag{
+						Name:  "piece-cache-path",
+						Usage: "Directory of verified pieces that are reused when a piece is proposed again instead of downloading it again, preferably on the same filesystem as the download roots so pieces are hardlinked instead of copied (disabled when empty)",
+					},
+					&cli.StringFlag{
+						Name:  "piece-cache-size",
+						Value: "1TiB",
+						Usage: "Bytes the piece cache holds at most, the least recently used pieces are evicted beyond this",
+					},
+					&cli.StringFlag{
+						Name:  "state-path",
+						Value: config.DefaultStatePath(),
+						Usage: "The location where the client keeps its state across restarts",
 					},
 					&cli.IntFlag{
-						Name:  "max-spade-deals-active",
+						Name:  "max-reservations",
 						Value: 2,
-						Usage: "Total number of spade deals that should be actively downloading / requesting (This doesn't include other deals or sealing!)",
+						Usage: "Number of reserved spade pieces that can be waiting for their deal proposal",
+					},
+					&cli.DurationFlag{
+						Name:  "reservation-ttl",
+						Value: 24 * time.Hour,
+						Usage: "How long a reserved piece can wait for its deal proposal before it is given up, 0 waits until it fails",
+					},
+					&cli.IntFlag{
+						Name:  "max-downloads",
+						Value: 2,
+						Usage: "Number of spade deals that can be downloading at the same time",
+					},
+					&cli.IntFlag{
+						Name:  "max-imports",
+						Value: 1,
+						Usage: "Number of downloaded spade deals that can be importing into Boost at the same time",
+					},
+					&cli.IntFlag{
+						Name:  "queue-size",
+						Value: 100,
+						Usage: "Number of matched deal proposals that can wait for a download slot, the ones with the earliest deadline go first",
+					},
+					&cli.IntFlag{
+						Name:  "download-parallelism",
+						Value: 50,
+						Usage: "Number of segments of a piece that are downloaded at the same time",
+					},
+					&cli.DurationFlag{
+						Name:  "download-timeout",
+						Value: 10 * time.Minute,
+						Usage: "Timeout for downloading a segment",
+					},
+					&cli.IntFlag{
+						Name:  "download-retries",
+						Value: 5,
+						Usage: "Number of times a failing segment download is retried",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tenant-download",
+						Usage: "Override a download setting for the deals of a tenant, as Tenant:Setting=Value where the setting is parallelism, timeout or retries (e.g. 12:parallelism=10). Can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "downloader",
+						Value: "assembler",
+						Usage: "Backend that downloads the pieces: assembler (the segments in the manifest), http (the whole piece from one URL), local (copy from a local or NFS path) or aria2 (an external aria2 daemon)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tenant-downloader",
+						Usage: "Backend that downloads the pieces of a tenant, as Tenant=Backend (e.g. 12=http). Can be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name:  "host-downloader",
+						Usage: "Backend that downloads the pieces with a source on a host, as Host=Backend (e.g. data.example.com=aria2). Can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "piece-url",
+						Usage: "URL of whole pieces for the http and aria2 backends instead of the sources in Spade, {piece_cid}, {pcid_v2} and {proposal_id} are filled in (e.g. https://data.example.com/piece/{piece_cid})",
+					},
+					&cli.StringFlag{
+						Name:  "local-piece-path",
+						Usage: "Path of whole pieces for the local backend, {piece_cid}, {pcid_v2} and {proposal_id} are filled in (e.g. /mnt/nfs/pieces/{piece_cid}.car)",
+					},
+					&cli.StringFlag{
+						Name:  "aria2-url",
+						Value: "ws://127.0.0.1:6800/jsonrpc",
+						Usage: "RPC URL of the aria2 daemon for the aria2 backend",
+					},
+					&cli.StringFlag{
+						Name:  "aria2-secret",
+						Usage: "RPC secret of the aria2 daemon",
+					},
+					&cli.StringSliceFlag{
+						Name:  "source-allow",
+						Usage: "Only download from this host, or from all hosts in a domain as *.domain. Can be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name:  "source-deny",
+						Usage: "Never download from this host, or from any host in a domain as *.domain. Can be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name:  "source-rewrite",
+						Usage: "Replace the prefix of source URLs, as From=To (e.g. https://data.example.com/=http://127.0.0.1:3128/data.example.com/ to use a caching proxy). Can be repeated",
+					},
+					&cli.Float64Flag{
+						Name:  "source-max-error-rate",
+						Value: 0,
+						Usage: "Skip hosts with a higher recent error rate (0-1) until they haven't failed for the source cooldown, 0 never skips hosts",
+					},
+					&cli.DurationFlag{
+						Name:  "source-cooldown",
+						Value: 5 * time.Minute,
+						Usage: "How long hosts with a high error rate are skipped after their last failure",
+					},
+					&cli.StringFlag{
+						Name:  "bandwidth-limit",
+						Value: "0",
+						Usage: "Bytes per second shared by all downloads (e.g. 100MiB), 0 is unlimited",
+					},
+					&cli.StringFlag{
+						Name:  "deal-bandwidth-limit",
+						Value: "0",
+						Usage: "Bytes per second per download (e.g. 20MiB), 0 is unlimited",
+					},
+					&cli.StringSliceFlag{
+						Name:  "bandwidth-schedule",
+						Usage: "Bytes per second shared by all downloads during a window, as Window=Rate (e.g. \"Mon-Fri 08:00-18:00=50MiB\"), the first matching window wins. Can be repeated",
+					},
+					&cli.DurationFlag{
+						Name:  "progress-interval",
+						Value: time.Minute,
+						Usage: "How often the progress of running downloads is logged, 0 disables it",
+					},
+					&cli.DurationFlag{
+						Name:  "gc-interval",
+						Value: time.Hour,
+						Usage: "How often files that are no longer needed are removed from the download path, 0 disables it",
+					},
+					&cli.DurationFlag{
+						Name:  "gc-grace-period",
+						Value: 24 * time.Hour,
+						Usage: "How long files of failed deals and quarantined files are kept before they are removed",
+					},
+					&cli.DurationFlag{
+						Name:  "deal-retention",
+						Value: 7 * 24 * time.Hour,
+						Usage: "How long imported, cancelled and failed deals are kept in the state once their files are removed, 0 keeps them",
+					},
+					&cli.BoolFlag{
+						Name:  "gc-dry-run",
+						Usage: "Only log which files would be removed from the download path",
+					},
+					&cli.BoolFlag{
+						Name:  "verify-downloads",
+						Value: true,
+						Usage: "Compare the piece commitment of downloaded files with the manifest and the proposal before import, mismatching files are moved to the quarantine directory in the download path and their proposal is not downloaded again",
+					},
+					&cli.IntFlag{
+						Name:  "max-spade-deals-active",
+						Usage: "Deprecated: sets both --max-reservations and --max-downloads",
+					},
+					&cli.StringSliceFlag{
+						Name:  "sealing-limit",
+						Usage: "Stop requesting new deals when the sealing pipeline holds this many sectors in a state, as State=Amount (e.g. AddPiece=4, PC1=8, WaitSeed=20). Can be repeated",
+					},
+					&cli.DurationFlag{
+						Name:  "sealing-duration",
+						Value: 8 * time.Hour,
+						Usage: "Estimate of how long sealing takes after import, proposals that can not be sealed before their start are skipped",
+					},
+					&cli.DurationFlag{
+						Name:  "requested-piece-ttl",
+						Value: 72 * time.Hour,
+						Usage: "How long a piece we requested is not requested again, e.g. after its reservation failed. 0 never requests it again",
+					},
+					&cli.StringFlag{
+						Name:  "piece-selection",
+						Value: "first-fit",
+						Usage: "How to pick the next piece to reserve: first-fit, random, tenant-round-robin, smallest-first, largest-first or fewest-sources-last",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tenant-weight",
+						Usage: "Weight of a tenant for the tenant-round-robin piece selection, as Tenant=Weight (default weight is 1). Can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "daily-budget",
+						Value: "0",
+						Usage: "Padded bytes to reserve at most per rolling day (e.g. 20TiB), 0 is unlimited",
+					},
+					&cli.StringFlag{
+						Name:  "weekly-budget",
+						Value: "0",
+						Usage: "Padded bytes to reserve at most per rolling week (e.g. 100TiB), 0 is unlimited",
+					},
+					&cli.StringSliceFlag{
+						Name:  "reservation-blackout",
+						Usage: "Window in which no new pieces are reserved, as [Days] HH:MM-HH:MM in local time (e.g. \"Mon-Fri 17:00-21:00\" or \"22:00-06:00\"). Can be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "min-piece-size",
+						Value: "0",
+						Usage: "Smallest padded piece size to reserve (e.g. 16GiB)",
+					},
+					&cli.StringFlag{
+						Name:  "max-piece-size",
+						Value: "0",
+						Usage: "Largest padded piece size to reserve, 0 means up to the sector size of the miner",
+					},
+					&cli.BoolFlag{
+						Name:  "probe-sources",
+						Usage: "Check whether a sample of the sources of a piece responds before reserving it, and skip pieces without a reachable source",
+					},
+					&cli.IntFlag{
+						Name:  "probe-samples",
+						Value: 3,
+						Usage: "Number of sources of a piece that are probed at the same time, 0 probes all of them",
+					},
+					&cli.DurationFlag{
+						Name:  "probe-timeout",
+						Value: 5 * time.Second,
+						Usage: "Timeout for probing a source",
+					},
+					&cli.DurationFlag{
+						Name:  "probe-cache-duration",
+						Value: 30 * time.Minute,
+						Usage: "How long the probe result of a piece is remembered",
+					},
+					&cli.DurationFlag{
+						Name:  "probe-budget",
+						Value: 30 * time.Second,
+						Usage: "Time spent probing sources per request for a new deal, pieces that are not probed in time are left for a next scan. 0 is unlimited",
+					},
+					&cli.IntSliceFlag{
+						Name:  "allow-tenant",
+						Usage: "Only reserve pieces claimed by this Spade tenant ID. Can be repeated",
+					},
+					&cli.IntSliceFlag{
+						Name:  "deny-tenant",
+						Usage: "Never reserve pieces for this Spade tenant ID. Can be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tenant-quota",
+						Usage: "Limit the bytes reserved for a tenant per rolling day or week, as Tenant:daily=Size or Tenant:weekly=Size (e.g. 12:daily=10TiB). Can be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name:  "boost-path-map",
+						Usage: "Path Boost mounts a local download directory under, as LocalPath=BoostPath (e.g. /mnt/downloads=/srv/spade). Can be repeated",
+					},
+					&cli.BoolFlag{
+						Name:  "boost-path-check",
+						Usage: "Check at startup that Boost can open the files in every download root, by having it open a marker file. On by default when there are Boost path mappings",
 					},
 					&cli.IntFlag{
 						Name:  "boost-graphql-port",
@@ -58,13 +319,193 @@ func main() {
 				Action: func(cCtx *cli.Context) error {
 					cfg := config.NewDefaultConfiguration()
 					cfg.DownloadPath = cCtx.String("download-path")
-					cfg.MaxSpadeDealsActive = cCtx.Int("max-spade-deals-active")
+					cfg.StatePath = cCtx.String("state-path")
+
+					downloadRoots, err := config.ParseDownloadRoots(cCtx.StringSlice("download-root"))
+					if err != nil {
+						return err
+					}
+					cfg.DownloadRoots = downloadRoots
+					cfg.DownloadPlacement = cCtx.String("download-placement")
+					if cfg.DownloadPlacement != config.PlaceByFreeSpace && cfg.DownloadPlacement != config.PlaceRoundRobin {
+						return fmt.Errorf("--download-placement should be %s or %s", config.PlaceByFreeSpace, config.PlaceRoundRobin)
+					}
+
+					spaceReserve, err := humanize.ParseBytes(cCtx.String("download-space-reserve"))
+					if err != nil {
+						return err
+					}
+					cfg.DownloadSpaceReserve = spaceReserve
+					cfg.PieceCachePath = cCtx.String("piece-cache-path")
+					pieceCacheSize, err := humanize.ParseBytes(cCtx.String("piece-cache-size"))
+					if err != nil {
+						return err
+					}
+					cfg.PieceCacheSize = pieceCacheSize
+					cfg.MaxReservations = cCtx.Int("max-reservations")
+					cfg.ReservationTTL = cCtx.Duration("reservation-ttl")
+					cfg.MaxDownloads = cCtx.Int("max-downloads")
+					cfg.MaxImports = cCtx.Int("max-imports")
+					cfg.QueueSize = cCtx.Int("queue-size")
+					if cCtx.IsSet("max-spade-deals-active") {
+						log.Warnf("--max-spade-deals-active is deprecated, use --max-reservations and --max-downloads")
+						cfg.MaxReservations = cCtx.Int("max-spade-deals-active")
+						cfg.MaxDownloads = cCtx.Int("max-spade-deals-active")
+					}
+					if cfg.MaxDownloads < 1 || cfg.MaxImports < 1 || cfg.QueueSize < 1 {
+						return fmt.Errorf("--max-downloads, --max-imports and --queue-size should be at least 1")
+					}
+					cfg.DownloadConfig.Parallelism = cCtx.Int("download-parallelism")
+					cfg.DownloadConfig.Timeout = cCtx.Duration("download-timeout")
+					cfg.DownloadConfig.Retries = cCtx.Int("download-retries")
+					if cfg.DownloadConfig.Parallelism < 1 || cfg.DownloadConfig.Timeout < time.Second || cfg.DownloadConfig.Retries < 0 {
+						return fmt.Errorf("--download-parallelism should be at least 1, --download-timeout at least 1s and --download-retries can not be negative")
+					}
+					downloadOverrides, err := config.ParseTenantDownloadOverrides(cCtx.StringSlice("tenant-download"))
+					if err != nil {
+						return err
+					}
+					cfg.DownloadConfig.TenantOverrides = downloadOverrides
+					cfg.DownloadConfig.Backend = cCtx.String("downloader")
+					tenantBackends, err := config.ParseTenantBackends(cCtx.StringSlice("tenant-downloader"))
+					if err != nil {
+						return err
+					}
+					cfg.DownloadConfig.TenantBackends = tenantBackends
+					hostBackends, err := config.ParseHostBackends(cCtx.StringSlice("host-downloader"))
+					if err != nil {
+						return err
+					}
+					cfg.DownloadConfig.HostBackends = hostBackends
+					cfg.DownloadConfig.PieceUrl = cCtx.String("piece-url")
+					cfg.DownloadConfig.LocalPiecePath = cCtx.String("local-piece-path")
+					cfg.DownloadConfig.Aria2Url = cCtx.String("aria2-url")
+					cfg.DownloadConfig.Aria2Secret = cCtx.String("aria2-secret")
+					cfg.DownloadConfig.SourceAllow = cCtx.StringSlice("source-allow")
+					cfg.DownloadConfig.SourceDeny = cCtx.StringSlice("source-deny")
+					sourceRewrites, err := config.ParseUrlRewrites(cCtx.StringSlice("source-rewrite"))
+					if err != nil {
+						return err
+					}
+					cfg.DownloadConfig.SourceRewrites = sourceRewrites
+					cfg.DownloadConfig.SourceMaxErrorRate = cCtx.Float64("source-max-error-rate")
+					cfg.DownloadConfig.SourceCooldown = cCtx.Duration("source-cooldown")
+					bandwidthLimit, err := config.ParseBandwidth(cCtx.String("bandwidth-limit"))
+					if err != nil {
+						return err
+					}
+					cfg.DownloadConfig.BandwidthLimit = bandwidthLimit
+					dealBandwidthLimit, err := config.ParseBandwidth(cCtx.String("deal-bandwidth-limit"))
+					if err != nil {
+						return err
+					}
+					cfg.DownloadConfig.DealBandwidthLimit = dealBandwidthLimit
+					bandwidthSchedule, err := config.ParseBandwidthSchedule(cCtx.StringSlice("bandwidth-schedule"))
+					if err != nil {
+						return err
+					}
+					cfg.DownloadConfig.BandwidthSchedule = bandwidthSchedule
+					cfg.ProgressInterval = cCtx.Duration("progress-interval")
+					cfg.VerifyDownloads = cCtx.Bool("verify-downloads")
+					cfg.GCInterval = cCtx.Duration("gc-interval")
+					cfg.GCGracePeriod = cCtx.Duration("gc-grace-period")
+					cfg.GCDryRun = cCtx.Bool("gc-dry-run")
+					cfg.DealRetention = cCtx.Duration("deal-retention")
+					cfg.SealingDuration = cCtx.Duration("sealing-duration")
 					cfg.BoostConfig.GraphQlPort = cCtx.Int("boost-graphql-port")
+					pathMappings, err := config.ParsePathMappings(cCtx.StringSlice("boost-path-map"))
+					if err != nil {
+						return err
+					}
+					cfg.BoostConfig.PathMappings = pathMappings
+					cfg.BoostConfig.CheckPaths = cCtx.Bool("boost-path-check")
+					if !cCtx.IsSet("boost-path-check") {
+						cfg.BoostConfig.CheckPaths = len(pathMappings) > 0
+					}
+
+					sealingLimits, err := config.ParseSealingLimits(cCtx.StringSlice("sealing-limit"))
+					if err != nil {
+						return err
+					}
+					cfg.SealingLimits = sealingLimits
+
+					cfg.SpadeConfig.RequestedPieceTTL = cCtx.Duration("requested-piece-ttl")
+					cfg.SpadeConfig.PieceSelection = cCtx.String("piece-selection")
+					tenantWeights, err := config.ParseTenantWeights(cCtx.StringSlice("tenant-weight"))
+					if err != nil {
+						return err
+					}
+					cfg.SpadeConfig.TenantWeights = tenantWeights
+
+					dailyBudget, err := humanize.ParseBytes(cCtx.String("daily-budget"))
+					if err != nil {
+						return err
+					}
+					cfg.DailyBudget = dailyBudget
+					weeklyBudget, err := humanize.ParseBytes(cCtx.String("weekly-budget"))
+					if err != nil {
+						return err
+					}
+					cfg.WeeklyBudget = weeklyBudget
+
+					blackouts, err := schedule.ParseWindows(cCtx.StringSlice("reservation-blackout"))
+					if err != nil {
+						return err
+					}
+					cfg.ReservationBlackouts = blackouts
+
+					minPieceSize, err := humanize.ParseBytes(cCtx.String("min-piece-size"))
+					if err != nil {
+						return err
+					}
+					cfg.SpadeConfig.MinPieceSize = minPieceSize
+					maxPieceSize, err := humanize.ParseBytes(cCtx.String("max-piece-size"))
+					if err != nil {
+						return err
+					}
+					cfg.SpadeConfig.MaxPieceSize = maxPieceSize
+					cfg.SpadeConfig.ProbeSources = cCtx.Bool("probe-sources")
+					cfg.SpadeConfig.ProbeSamples = cCtx.Int("probe-samples")
+					cfg.SpadeConfig.ProbeTimeout = cCtx.Duration("probe-timeout")
+					cfg.SpadeConfig.ProbeCacheDuration = cCtx.Duration("probe-cache-duration")
+					cfg.SpadeConfig.ProbeBudget = cCtx.Duration("probe-budget")
+
+					for _, tenant := range cCtx.IntSlice("allow-tenant") {
+						cfg.SpadeConfig.AllowedTenants = append(cfg.SpadeConfig.AllowedTenants, int16(tenant))
+					}
+					for _, tenant := range cCtx.IntSlice("deny-tenant") {
+						cfg.SpadeConfig.DeniedTenants = append(cfg.SpadeConfig.DeniedTenants, int16(tenant))
+					}
+					tenantQuotas, err := config.ParseTenantQuotas(cCtx.StringSlice("tenant-quota"))
+					if err != nil {
+						return err
+					}
+					cfg.SpadeConfig.TenantQuotas = tenantQuotas
 
 					startClient(cCtx.Context, cfg)
 					return nil
 				},
 			},
+			{
+				Name:    "status",
+				Aliases: []string{"s"},
+				Usage:   "Shows what a (running) Spade Client is doing",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "state-path",
+						Value: config.DefaultStatePath(),
+						Usage: "The location where the client keeps its state across restarts",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					store := state.New(cCtx.String("state-path"))
+					err := store.Load()
+					if err != nil {
+						return err
+					}
+					return client.PrintStatus(os.Stdout, store)
+				},
+			},
 		},
 	}
 
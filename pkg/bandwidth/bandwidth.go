@@ -0,0 +1,157 @@
+package bandwidth
+
+import (
+	"context"
+	"filecoin-spade-client/pkg/config"
+	"filecoin-spade-client/pkg/log"
+	"github.com/dustin/go-humanize"
+	"golang.org/x/time/rate"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Smallest burst, so low limits don't split reads into tiny pieces
+const minBurst = 64 << 10
+
+type dealLimiterKey struct{}
+
+// Limiter is a token bucket shared by all downloads, with an optional bucket per download on top of it
+type Limiter struct {
+	config config.DownloadConfig
+
+	mutex   sync.Mutex
+	global  *rate.Limiter
+	current uint64 // the shared limit that is in effect
+}
+
+func New(config config.DownloadConfig) *Limiter {
+	l := new(Limiter)
+	l.config = config
+	l.global = rate.NewLimiter(rate.Inf, minBurst)
+	l.apply(l.limitAt(time.Now()))
+	return l
+}
+
+// limitAt returns the shared limit at time t, and the schedule window it comes from
+func (l *Limiter) limitAt(t time.Time) (uint64, string) {
+	for _, rule := range l.config.BandwidthSchedule {
+		if rule.Window.Contains(t) {
+			return rule.Limit, rule.Window.String()
+		}
+	}
+	return l.config.BandwidthLimit, ""
+}
+
+// Refresh applies the schedule, it is called before every read but can also be called periodically
+func (l *Limiter) Refresh() {
+	limit, window := l.limitAt(time.Now())
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if limit != l.current {
+		l.apply(limit, window)
+	}
+}
+
+func (l *Limiter) apply(limit uint64, window string) {
+	l.current = limit
+	l.global.SetLimit(limitOf(limit))
+	l.global.SetBurst(burstOf(limit))
+
+	switch {
+	case window != "":
+		log.Infof("Download bandwidth limited to %s/s during %q", humanize.IBytes(limit), window)
+	case limit > 0:
+		log.Infof("Download bandwidth limited to %s/s", humanize.IBytes(limit))
+	default:
+		log.Infof("Download bandwidth is unlimited")
+	}
+}
+
+// Current returns the shared limit in bytes per second that is in effect, 0 is unlimited
+func (l *Limiter) Current() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.current
+}
+
+// WithDeal returns a context for a single download. Only responses to requests made with such a context are
+// limited, by the shared limit and the per deal limit; other requests (e.g. to Spade or Boost) are not.
+func (l *Limiter) WithDeal(ctx context.Context) context.Context {
+	var limiter *rate.Limiter
+	if l.config.DealBandwidthLimit > 0 {
+		limiter = rate.NewLimiter(limitOf(l.config.DealBandwidthLimit), burstOf(l.config.DealBandwidthLimit))
+	}
+	return context.WithValue(ctx, dealLimiterKey{}, limiter)
+}
+
+// Transport wraps next, limiting the response bodies it returns
+func (l *Limiter) Transport(next http.RoundTripper) http.RoundTripper {
+	return &transport{limiter: l, next: next}
+}
+
+type transport struct {
+	limiter *Limiter
+	next    http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	deal, ok := req.Context().Value(dealLimiterKey{}).(*rate.Limiter)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	limiters := []*rate.Limiter{t.limiter.global}
+	if deal != nil {
+		limiters = append(limiters, deal)
+	}
+	resp.Body = &body{ReadCloser: resp.Body, ctx: req.Context(), limiter: t.limiter, limiters: limiters}
+	return resp, nil
+}
+
+type body struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiter  *Limiter
+	limiters []*rate.Limiter
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	b.limiter.Refresh()
+
+	for _, limiter := range b.limiters {
+		if burst := limiter.Burst(); len(p) > burst {
+			p = p[:burst]
+		}
+	}
+	n, err := b.ReadCloser.Read(p)
+	for _, limiter := range b.limiters {
+		// The burst may have changed with the schedule in the meantime
+		for remaining := n; remaining > 0; {
+			chunk := min(remaining, limiter.Burst())
+			if waitErr := limiter.WaitN(b.ctx, chunk); waitErr != nil {
+				return n, waitErr
+			}
+			remaining -= chunk
+		}
+	}
+	return n, err
+}
+
+func limitOf(bytesPerSecond uint64) rate.Limit {
+	if bytesPerSecond == 0 {
+		return rate.Inf
+	}
+	return rate.Limit(bytesPerSecond)
+}
+
+// burstOf allows a tenth of a second worth of data at once
+func burstOf(bytesPerSecond uint64) int {
+	return max(minBurst, int(bytesPerSecond/10))
+}
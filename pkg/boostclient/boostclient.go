@@ -13,9 +13,12 @@ import (
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-jsonrpc"
 	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
 	"golang.org/x/xerrors"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -162,13 +165,60 @@ func (bc *BoostClient) GetBoostDeals(ctx context.Context) (*BoostDealsResponse,
 	return &responseObject, nil
 }
 
+type BoostDeal struct {
+	ID         uuid.UUID `json:"ID"`
+	Checkpoint string    `json:"Checkpoint"`
+	Err        string    `json:"Err"`
+	PieceCid   string    `json:"PieceCid"`
+	Message    string    `json:"Message"`
+}
+
+type BoostDealResponse struct {
+	Data struct {
+		Deal *BoostDeal `json:"deal"`
+	} `json:"data"`
+}
+
+// GetBoostDeal returns the deal with the given ID, or nil when Boost doesn't know it
+func (bc *BoostClient) GetBoostDeal(ctx context.Context, dealId string) (*BoostDeal, error) {
+	vars := struct {
+		Id string `json:"id"`
+	}{
+		Id: dealId,
+	}
+	request := GraphQLRequest{
+		OperationName: "AppDealQuery",
+		Query:         "query AppDealQuery($id: ID!) { deal(id: $id) { ID Checkpoint Err PieceCid Message } }",
+		Variables:     vars,
+	}
+
+	resp, err := bc.graphQlQuery(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	var responseObject BoostDealResponse
+	err = json.Unmarshal(resp, &responseObject)
+	if err != nil {
+		log.Warnf("Could not unmarshal data:\n%s", resp)
+		return nil, err
+	}
+
+	return responseObject.Data.Deal, nil
+}
+
 func (bc *BoostClient) ImportDeal(ctx context.Context, proposal *spadeclient.DealProposal, filepath string) error {
-	log.Infof("Importing Boost deal %s with data %s", proposal.ProposalID, filepath)
+	boostPath := bc.Config.BoostPath(filepath)
+	if boostPath != filepath {
+		log.Infof("Importing Boost deal %s with data %s (%s for Boost)", proposal.ProposalID, filepath, boostPath)
+	} else {
+		log.Infof("Importing Boost deal %s with data %s", proposal.ProposalID, filepath)
+	}
 	actualUuid, err := uuid.Parse(proposal.ProposalID)
 	if err != nil {
 		return err
 	}
-	response, err := bc.Api.BoostOfflineDealWithData(ctx, actualUuid, filepath, true)
+	response, err := bc.Api.BoostOfflineDealWithData(ctx, actualUuid, boostPath, true)
 	if err != nil {
 		return err
 	}
@@ -178,6 +228,37 @@ func (bc *BoostClient) ImportDeal(ctx context.Context, proposal *spadeclient.Dea
 	return nil
 }
 
+// Errors of the legacy deal import when the file was opened, but the deal doesn't exist
+var dealNotFoundErrors = []string{"failed getting deal", "deal not found"}
+
+// CanOpen returns whether Boost can open the file at the given path. Boost has no call to check for a file, so
+// this asks it to import the file for a legacy deal that doesn't exist: Boost opens the file before it looks up
+// the deal. The result is only conclusive when ok is true, any error we don't recognise is inconclusive.
+func (bc *BoostClient) CanOpen(ctx context.Context, path string) (exists bool, ok bool) {
+	hash, err := multihash.Sum([]byte(path), multihash.SHA2_256, -1)
+	if err != nil {
+		return false, false
+	}
+	err = bc.Api.MarketImportDealData(ctx, cid.NewCidV1(cid.Raw, hash), path)
+	if err == nil {
+		// Can't happen for a made up deal, don't trust it
+		log.Debugf("Boost imported %s for a deal that doesn't exist", path)
+		return false, false
+	}
+	if strings.Contains(err.Error(), "failed to open file") {
+		return false, true
+	}
+	for _, notFound := range dealNotFoundErrors {
+		if strings.Contains(err.Error(), notFound) {
+			// Boost got past opening the file, and failed to find the deal
+			log.Debugf("Boost opened %s: %s", path, err)
+			return true, true
+		}
+	}
+	log.Debugf("Could not check %s in Boost: %s", path, err)
+	return false, false
+}
+
 type BoostCancelDealResponse struct {
 	Data struct {
 		DealCancel string `json:"dealCancel"`
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"math"
+	"time"
+)
+
+// Budget is how much we reserved in the rolling day and week, against the configured limits (0 is unlimited)
+type Budget struct {
+	DailyUsed   uint64 `json:"daily_used"`
+	DailyLimit  uint64 `json:"daily_limit"`
+	WeeklyUsed  uint64 `json:"weekly_used"`
+	WeeklyLimit uint64 `json:"weekly_limit"`
+}
+
+func (cl *Client) budget() Budget {
+	return Budget{
+		DailyUsed:   cl.SpadeClient.ReservedBytes(24 * time.Hour),
+		DailyLimit:  cl.Configuration.DailyBudget,
+		WeeklyUsed:  cl.SpadeClient.ReservedBytes(7 * 24 * time.Hour),
+		WeeklyLimit: cl.Configuration.WeeklyBudget,
+	}
+}
+
+// Remaining returns how many bytes can still be reserved within both budgets
+func (b Budget) Remaining() uint64 {
+	remaining := uint64(math.MaxUint64)
+	if b.DailyLimit > 0 {
+		remaining = min(remaining, b.DailyLimit-min(b.DailyUsed, b.DailyLimit))
+	}
+	if b.WeeklyLimit > 0 {
+		remaining = min(remaining, b.WeeklyLimit-min(b.WeeklyUsed, b.WeeklyLimit))
+	}
+	return remaining
+}
+
+func (b Budget) String() string {
+	return fmt.Sprintf("%s today, %s this week", formatUsage(b.DailyUsed, b.DailyLimit), formatUsage(b.WeeklyUsed, b.WeeklyLimit))
+}
+
+func formatUsage(used uint64, limit uint64) string {
+	if limit == 0 {
+		return fmt.Sprintf("%s (unlimited)", humanize.IBytes(used))
+	}
+	return fmt.Sprintf("%s of %s", humanize.IBytes(used), humanize.IBytes(limit))
+}
@@ -2,49 +2,145 @@ package client
 
 import (
 	"context"
+	"filecoin-spade-client/pkg/bandwidth"
 	"filecoin-spade-client/pkg/boostclient"
 	"filecoin-spade-client/pkg/config"
+	"filecoin-spade-client/pkg/deal"
+	"filecoin-spade-client/pkg/downloader"
 	"filecoin-spade-client/pkg/log"
 	"filecoin-spade-client/pkg/lotusclient"
+	"filecoin-spade-client/pkg/piececache"
+	"filecoin-spade-client/pkg/schedule"
+	"filecoin-spade-client/pkg/sources"
 	"filecoin-spade-client/pkg/spadeclient"
+	"filecoin-spade-client/pkg/state"
 	"fmt"
+	"github.com/dustin/go-humanize"
+	fildatasegment "github.com/ribasushi/fil-datasegment/pkg/dlass"
+	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
 )
 
+// The default transport before we replaced it
+var baseTransport = http.DefaultTransport
+
+var installTransport sync.Once
+
+const (
+	duplicateDealsBucket = "duplicate_deals"
+	failuresBucket       = "failures"
+)
+
 type Client struct {
-	Configuration           config.Configuration
-	LotusClient             *lotusclient.LotusClient
-	SpadeClient             *spadeclient.SpadeClient
-	BoostClient             *boostclient.BoostClient
-	DuplicateDeals          map[string]string
-	DuplicateDealsMutex     sync.Mutex
-	ActiveDeals             map[string]*spadeclient.DealProposal
-	ActiveDealsMutex        sync.Mutex
-	ImportedDeals           map[string]bool
-	ImportedDealsMutex      sync.Mutex
-	WaitingForProposal      map[string]bool
-	WaitingForProposalMutex sync.Mutex
-	FailureMap              sync.Map
+	Configuration       config.Configuration
+	Store               *state.Store
+	LotusClient         *lotusclient.LotusClient
+	SpadeClient         *spadeclient.SpadeClient
+	BoostClient         *boostclient.BoostClient
+	DuplicateDeals      map[string]string
+	DuplicateDealsMutex sync.Mutex
+	Deals               map[string]*deal.Deal // by piece CID
+	DealsMutex          sync.Mutex
+	FailureMap          sync.Map
+	Throughput          Throughput
+	ThroughputMutex     sync.Mutex
+
+	Queue       *ProposalQueue
+	Bandwidth   *bandwidth.Limiter
+	Downloaders map[string]downloader.Downloader // by backend name
+	PieceCache  *piececache.Cache                // nil when disabled
+	Sources     *sources.Tracker
+
+	transport      http.RoundTripper // for the requests of downloads
+	downloadSlots  chan struct{}
+	importSlots    chan struct{}
+	downloads      map[string]*downloadTracker // by piece CID
+	downloadsMutex sync.Mutex
+	nextRoot       int // for the round-robin placement
+	placementMutex sync.Mutex
 }
 
 func New(config config.Configuration) *Client {
 	cl := new(Client)
 	cl.Configuration = config
+	cl.Store = state.New(config.StatePath)
 	cl.LotusClient = lotusclient.New(config)
-	cl.SpadeClient = spadeclient.New(config, cl.LotusClient)
+	cl.SpadeClient = spadeclient.New(config, cl.LotusClient, cl.Store)
 	cl.BoostClient = boostclient.New(config)
 	cl.DuplicateDeals = make(map[string]string)
-	cl.ActiveDeals = make(map[string]*spadeclient.DealProposal)
-	cl.ImportedDeals = make(map[string]bool)
-	cl.WaitingForProposal = make(map[string]bool)
+	cl.Deals = make(map[string]*deal.Deal)
+	cl.Queue = NewProposalQueue(config.QueueSize)
+	cl.Bandwidth = bandwidth.New(config.DownloadConfig)
+	cl.Sources = sources.New(config.DownloadConfig)
+
+	if config.PieceCachePath != "" {
+		cache, err := piececache.New(config.PieceCachePath, config.PieceCacheSize)
+		if err != nil {
+			log.Fatalf("error creating client: %+v", err)
+		}
+		cl.PieceCache = cache
+	}
+
+	// Limits and tracks the requests made for downloads, using the marks the download context carries. Requests
+	// without those marks pass untouched. The bandwidth limit is applied outside of the source tracking, so
+	// waiting for it doesn't count against the throughput of the hosts.
+	cl.transport = &progressTransport{next: cl.Bandwidth.Transport(cl.Sources.Transport(baseTransport))}
+	httpClient := &http.Client{Transport: cl.transport}
+
+	cl.Downloaders = make(map[string]downloader.Downloader)
+	backends := []string{config.DownloadConfig.Backend}
+	for _, backend := range config.DownloadConfig.TenantBackends {
+		backends = append(backends, backend)
+	}
+	for _, backend := range config.DownloadConfig.HostBackends {
+		backends = append(backends, backend)
+	}
+	for _, backend := range backends {
+		d, err := downloader.New(backend, config.DownloadConfig, httpClient)
+		if err != nil {
+			log.Fatalf("error creating client: %+v", err)
+		}
+		cl.Downloaders[backend] = d
+	}
+	cl.downloadSlots = make(chan struct{}, config.MaxDownloads)
+	cl.importSlots = make(chan struct{}, config.MaxImports)
+	cl.downloads = make(map[string]*downloadTracker)
 	return cl
 }
 
+// installTransport makes our transport the default one. The assembler (dlass.Agg.StartDownload) has no hooks for
+// its requests, it fetches the segments with the default HTTP client and the context it is given. download warns
+// when a download wrote data that never passed through our transport. Only the first client installs it.
+func (cl *Client) installTransport() {
+	installTransport.Do(func() {
+		http.DefaultTransport = cl.transport
+	})
+}
+
 func (cl *Client) Start(ctx context.Context) error {
 	log.Infof("Starting Spade Client...")
+	for _, root := range cl.Configuration.Roots() {
+		err := os.MkdirAll(root.Path, 0o755)
+		if err != nil {
+			return err
+		}
+	}
+	err := cl.Store.Load()
+	if err != nil {
+		return err
+	}
+	err = cl.loadState()
+	if err != nil {
+		return err
+	}
+
+	cl.installTransport()
+
 	newctx, cancelClient := context.WithCancel(ctx)
 	defer cancelClient()
 	cl.LotusClient.Start(newctx)
@@ -57,12 +153,28 @@ func (cl *Client) Start(ctx context.Context) error {
 	defer cancelSpade()
 	cl.SpadeClient.Start(spadectx)
 
-	//log.Infof("Requesting sealing pipeline")
-	//sealing, err := cl.BoostClient.GetBoostSealingPipeline(ctx)
-	//log.Infof("Spade deal data: %+v (%+v)", sealing, err)
+	if cl.Configuration.BoostConfig.CheckPaths {
+		err = cl.checkBoostPaths(boostctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = cl.resumeDeals(spadectx)
+	if err != nil {
+		log.Warnf("Could not resume deals from before the restart: %s", err)
+		cl.abandonActiveDeals("interrupted by a restart")
+	}
+
+	for _, window := range cl.Configuration.ReservationBlackouts {
+		log.Infof("No new pieces are reserved during blackout %q", window)
+	}
 
 	log.Infof("Spade client successfully started - starting main loop")
+	go cl.dispatchProposals(spadectx)
 	go cl.scanPendingProposals(spadectx)
+	go cl.reportProgress(spadectx)
+	go cl.collectGarbage(spadectx)
 
 	select {
 	case <-ctx.Done():
@@ -71,15 +183,64 @@ func (cl *Client) Start(ctx context.Context) error {
 	}
 }
 
+// loadState fills the in-memory state from the state store
+func (cl *Client) loadState() error {
+	err := cl.Store.View(func(tx *state.Tx) error {
+		for _, pieceCid := range tx.Keys(duplicateDealsBucket) {
+			var duplicate string
+			if _, err := tx.Get(duplicateDealsBucket, pieceCid, &duplicate); err != nil {
+				return err
+			}
+			cl.DuplicateDeals[pieceCid] = duplicate
+		}
+		for _, pieceCid := range tx.Keys(failuresBucket) {
+			var failure string
+			if _, err := tx.Get(failuresBucket, pieceCid, &failure); err != nil {
+				return err
+			}
+			cl.FailureMap.Store(pieceCid, failure)
+		}
+		if _, err := tx.Get(statsBucket, throughputKey, &cl.Throughput); err != nil {
+			return err
+		}
+		var hostStats map[string]sources.HostStats
+		if _, err := tx.Get(statsBucket, sourcesKey, &hostStats); err != nil {
+			return err
+		}
+		cl.Sources.Load(hostStats)
+		return cl.loadDeals(tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Loaded state: %d imported deals, %d in progress, %d waiting for proposal, %d duplicate deals", cl.CountDeals(deal.Imported), cl.CountActiveDeals(), cl.CountDeals(deal.Reserved), len(cl.DuplicateDeals))
+	return nil
+}
+
+// persist writes a single entry to the state store; failures are logged as the in-memory state is leading
+func (cl *Client) persist(bucket string, key string, value interface{}) {
+	err := cl.Store.Put(bucket, key, value)
+	if err != nil {
+		log.Warnf("Could not persist %s/%s: %s", bucket, key, err)
+	}
+}
+
+func (cl *Client) forget(bucket string, key string) {
+	err := cl.Store.Delete(bucket, key)
+	if err != nil {
+		log.Warnf("Could not remove %s/%s from state: %s", bucket, key, err)
+	}
+}
+
 func (cl *Client) scanPendingProposals(ctx context.Context) {
 	log.Infof("Scanning pending proposals with a ticker interval of %s", cl.SpadeClient.Config.PendingRefreshInterval.String())
 	ticker := time.NewTicker(cl.SpadeClient.Config.PendingRefreshInterval)
 	defer ticker.Stop()
 
-	totalRequested := 0
-
 	for {
 		var boostDeals *boostclient.BoostDealsResponse
+		var matched []spadeclient.DealProposal
 
 		log.Infof("> Fetching pending proposals")
 		pendingProposals, err := cl.SpadeClient.PendingProposals(ctx)
@@ -89,6 +250,7 @@ func (cl *Client) scanPendingProposals(ctx context.Context) {
 		}
 
 		log.Infof(" > %d pending proposals, %d recent failures", len(pendingProposals.PendingProposals), len(pendingProposals.RecentFailures))
+		cl.expireReservations(pendingProposals.PendingProposals)
 
 		// We take these failures, and if they are indeed duplicate failures, we cancel them
 		for _, failure := range pendingProposals.RecentFailures {
@@ -118,11 +280,10 @@ func (cl *Client) scanPendingProposals(ctx context.Context) {
 					// and it still shows the errors
 					cl.SpadeClient.AddRequestedPiece(failure.PieceCid)
 
-					// Also remove it from our requested pieces waiting list so we make some space for other deals
-					cl.RemoveWaitingForProposal(failure.PieceCid)
+					// Also stop waiting for its proposal so we make some space for other deals
+					cl.cancelReservation(failure.PieceCid, fmt.Sprintf("duplicate of Boost deal %s", duplicate))
 
-					// @TODO -> Remove the duplicate entry from the requested pieces and whatnot, after it expired
-					//   then we can request it again
+					// The requested piece expires after the requested piece TTL, then we can request it again
 				}
 			} else {
 				if strings.Index(failure.Error, "cannot seal a sector before") != -1 {
@@ -132,9 +293,9 @@ func (cl *Client) scanPendingProposals(ctx context.Context) {
 
 				_, ok := cl.FailureMap.Load(failure.PieceCid)
 				if ok == false {
-					cl.RemoveWaitingForProposal(failure.PieceCid)
+					cl.failReservation(failure.PieceCid, failure.Error)
 					if strings.Index(failure.Error, "PHP Fatal error") == -1 {
-						cl.FailureMap.Store(failure.PieceCid, failure.Error)
+						cl.AddFailure(failure.PieceCid, failure.Error)
 						log.Warnf("   > PieceCID %s failed with %s", failure.PieceCid, failure.Error)
 					} else {
 						log.Warnf("   > PieceCID %s failed with %s local failure, not adding to failure map", failure.PieceCid, failure.Error)
@@ -147,6 +308,7 @@ func (cl *Client) scanPendingProposals(ctx context.Context) {
 
 		if len(pendingProposals.PendingProposals) == 0 {
 			//no pending proposals, lets skip the deal checking in boost
+			cl.Queue.Replace(nil)
 			goto scanNewDeals
 		}
 		log.Infof("> fetching open deals from Boost...")
@@ -159,47 +321,34 @@ func (cl *Client) scanPendingProposals(ctx context.Context) {
 		log.Infof(" > found %d deals in boost", boostDeals.Data.Deals.TotalCount)
 		// try to match deals to pending proposals
 	exit:
-		for _, deal := range boostDeals.Data.Deals.Deals {
+		for _, boostDeal := range boostDeals.Data.Deals.Deals {
 			// find it in the proposals
 			for _, proposal := range pendingProposals.PendingProposals {
-				if proposal.ProposalID == deal.ID.String() {
-					//log.Infof("  > Matched deal %s (proposalID=%s) [PieceCID=%s]", deal.ID, proposal.ProposalID, deal.PieceCid)
-					cl.RemoveWaitingForProposal(proposal.PieceCid)
-					go cl.HandleDeal(ctx, proposal)
+				if proposal.ProposalID == boostDeal.ID.String() {
+					//log.Infof("  > Matched deal %s (proposalID=%s) [PieceCID=%s]", boostDeal.ID, proposal.ProposalID, boostDeal.PieceCid)
+					matched = append(matched, proposal)
 					continue exit
 				} else {
 					// this should never happen, bug in Spade (handled above here in the failures)
 
-					//if proposal.PieceCid == deal.PieceCid {
-					//	log.Warnf("  > MATCHED ON PIECE %s (proposalID=%s) [PieceCID=%s]", deal.ID, proposal.ProposalID, deal.PieceCid)
+					//if proposal.PieceCid == boostDeal.PieceCid {
+					//	log.Warnf("  > MATCHED ON PIECE %s (proposalID=%s) [PieceCID=%s]", boostDeal.ID, proposal.ProposalID, boostDeal.PieceCid)
 					//}
 				}
 			}
 
-			//log.Infof(">>>> Did not find a proposal<->boost match for %s (%s)", deal.ID, deal.PieceCid)
+			//log.Infof(">>>> Did not find a proposal<->boost match for %s (%s)", boostDeal.ID, boostDeal.PieceCid)
 		}
+		cl.handleProposals(matched)
 
 	scanNewDeals:
+		// Pieces we requested long enough ago can be requested again, as if they never failed before
+		cl.forgetPieces(cl.SpadeClient.ExpireRequestedPieces())
+
 		// Now check if we should request some more proposals
-		cl.ActiveDealsMutex.Lock()
-		totalRequested = len(cl.ActiveDeals) + cl.GetAmountWaitingForProposal()
-		if totalRequested < cl.Configuration.MaxSpadeDealsActive {
-			repeat := cl.Configuration.MaxSpadeDealsActive - totalRequested
-			log.Infof("Currently handling %d deals (%d active, %d requested), less than given limit of %d, requesting new deal %d times", totalRequested, len(cl.ActiveDeals), cl.GetAmountWaitingForProposal(), cl.Configuration.MaxSpadeDealsActive, repeat)
-			for i := 0; i < repeat; i++ {
-				requested, err := cl.SpadeClient.RequestNewDeal(ctx)
-				if err != nil {
-					log.Warnf("Could not request new deal from Spade: %s", err)
-					i = repeat // make sure we stop trying
-				} else {
-					cl.AddWaitingForProposal(requested)
-				}
-			}
-		} else {
-			log.Infof("Currently handling %d deals (%d active, %d requested), not requesting new deals", totalRequested, len(cl.ActiveDeals), cl.GetAmountWaitingForProposal())
-		}
-		cl.ActiveDealsMutex.Unlock()
+		cl.requestNewDeals(ctx)
 	ticker:
+		cl.writeStatus()
 		select {
 		case <-ticker.C: // Return back into the loop
 		case <-ctx.Done():
@@ -209,6 +358,135 @@ func (cl *Client) scanPendingProposals(ctx context.Context) {
 	}
 }
 
+// handleProposals queues the matched proposals we still have to handle, the ones with the earliest deadline first.
+// Proposals that can not be downloaded, imported and sealed before their start are skipped.
+func (cl *Client) handleProposals(proposals []spadeclient.DealProposal) {
+	var queue []spadeclient.DealProposal
+	for _, proposal := range proposals {
+		if d := cl.GetDeal(proposal.PieceCid); d != nil && d.ProposalID == proposal.ProposalID && (d.IsActive() || d.IsFinal() || failedVerification(d)) {
+			continue
+		}
+
+		if reason := cl.checkDeadline(proposal); reason != "" {
+			cl.skipProposal(proposal, reason)
+			continue
+		}
+
+		queue = append(queue, proposal)
+	}
+
+	dropped := cl.Queue.Replace(queue)
+	if dropped > 0 {
+		log.Warnf(" > Queue is full, %d proposals with the latest deadlines were left out", dropped)
+	}
+	log.Infof(" > %d proposals queued for download (queue size %d), %d of %d download slots in use", cl.Queue.Len(), cl.Queue.Capacity(), len(cl.downloadSlots), cap(cl.downloadSlots))
+}
+
+// dispatchProposals hands the queued proposals to the download slots as they free up. A slot is only taken once
+// there is a proposal for it, so resumed deals don't wait for a slot held by an empty queue.
+func (cl *Client) dispatchProposals(ctx context.Context) {
+	for {
+		if !cl.Queue.Wait(ctx) {
+			return
+		}
+		if !cl.acquireDownloadSlot(ctx) {
+			return
+		}
+
+		// The queue may have been replaced while we waited for the slot
+		proposal, ok := cl.Queue.TryPop()
+		if !ok {
+			cl.releaseDownloadSlot()
+			continue
+		}
+
+		if !cl.claimDeal(proposal) {
+			cl.releaseDownloadSlot()
+			continue
+		}
+		go cl.processDeal(ctx, proposal, true)
+	}
+}
+
+func (cl *Client) acquireDownloadSlot(ctx context.Context) bool {
+	select {
+	case cl.downloadSlots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (cl *Client) releaseDownloadSlot() {
+	<-cl.downloadSlots
+}
+
+func (cl *Client) requestNewDeals(ctx context.Context) {
+	if window, active := schedule.Active(cl.Configuration.ReservationBlackouts, time.Now()); active {
+		log.Infof("Reservation blackout %q is active, not requesting new deals (reserved deals are still handled)", window)
+		return
+	}
+
+	reserved := cl.CountDeals(deal.Reserved)
+	downloading := cl.CountDeals(downloadStates...)
+	importing := cl.CountDeals(deal.Downloaded, deal.Importing)
+	if reserved >= cl.Configuration.MaxReservations {
+		log.Infof("Currently handling %d reservations, %d downloads and %d imports, at the limit of %d reservations, not requesting new deals", reserved, downloading, importing, cl.Configuration.MaxReservations)
+		return
+	}
+
+	repeat := cl.Configuration.MaxReservations - reserved
+	log.Infof("Currently handling %d reservations, %d downloads and %d imports, less than the limit of %d reservations", reserved, downloading, importing, cl.Configuration.MaxReservations)
+
+	capacity, err := cl.sealingCapacity(ctx)
+	if err != nil {
+		log.Warnf("Could not check the sealing pipeline, not requesting new deals: %s", err)
+		return
+	}
+	if capacity == 0 {
+		log.Infof("Sealing pipeline is at its configured limits, not requesting new deals")
+		return
+	}
+	if capacity > 0 && capacity < repeat {
+		repeat = capacity
+	}
+
+	available, err := cl.availableDiskSpace("")
+	if err != nil {
+		log.Warnf("Could not check the free space in the download roots, not requesting new deals: %s", err)
+		return
+	}
+	log.Infof("%s available in the download roots for new deals", humanize.IBytes(available))
+
+	budget := cl.budget()
+	log.Infof("Onboarding budget: %s", budget)
+	if budget.Remaining() == 0 {
+		log.Infof("Onboarding budget is used up, not requesting new deals")
+		return
+	}
+
+	log.Infof("Requesting new deal %d times", repeat)
+	for i := 0; i < repeat; i++ {
+		// Every reservation is placed in a download root, so check again what the next one can take
+		if i > 0 {
+			available, err = cl.availableDiskSpace("")
+			if err != nil {
+				log.Warnf("Could not check the free space in the download roots: %s", err)
+				return
+			}
+		}
+		room := min(available, cl.budget().Remaining())
+
+		requested, err := cl.SpadeClient.RequestNewDeal(ctx, room)
+		if err != nil {
+			log.Warnf("Could not request new deal from Spade: %s", err)
+			i = repeat // make sure we stop trying
+		} else if requested != nil {
+			cl.ReserveDeal(requested)
+		}
+	}
+}
+
 func (cl *Client) HasDuplicateDeal(pieceCid string) bool {
 	return cl.GetDuplicateDeal(pieceCid) != ""
 }
@@ -228,80 +506,145 @@ func (cl *Client) AddDuplicateDeal(pieceCid string, realProposalId string) {
 	defer cl.DuplicateDealsMutex.Unlock()
 
 	cl.DuplicateDeals[pieceCid] = realProposalId
+	cl.persist(duplicateDealsBucket, pieceCid, realProposalId)
 }
 
-func (cl *Client) IsAlreadyImported(proposalID string) bool {
-	cl.ImportedDealsMutex.Lock()
-	defer cl.ImportedDealsMutex.Unlock()
-
-	if _, ok := cl.ImportedDeals[proposalID]; ok {
-		return true
-	}
-	return false
+func (cl *Client) AddFailure(pieceCid string, failure string) {
+	cl.FailureMap.Store(pieceCid, failure)
+	cl.persist(failuresBucket, pieceCid, failure)
 }
 
-func (cl *Client) AddImported(proposalID string) {
-	cl.ImportedDealsMutex.Lock()
-	defer cl.ImportedDealsMutex.Unlock()
+// forgetPieces forgets the failures and duplicate deals of the pieces, so a new reservation of one of them is
+// handled like the first one
+func (cl *Client) forgetPieces(pieceCids []string) {
+	var forgotten []string
+	cl.DuplicateDealsMutex.Lock()
+	for _, pieceCid := range pieceCids {
+		_, failed := cl.FailureMap.LoadAndDelete(pieceCid)
+		_, duplicate := cl.DuplicateDeals[pieceCid]
+		delete(cl.DuplicateDeals, pieceCid)
+		if failed || duplicate {
+			forgotten = append(forgotten, pieceCid)
+		}
+	}
+	cl.DuplicateDealsMutex.Unlock()
+	if len(forgotten) == 0 {
+		return
+	}
 
-	cl.ImportedDeals[proposalID] = true
+	err := cl.Store.Update(func(tx *state.Tx) error {
+		for _, pieceCid := range forgotten {
+			if err := tx.Delete(failuresBucket, pieceCid); err != nil {
+				return err
+			}
+			if err := tx.Delete(duplicateDealsBucket, pieceCid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Could not remove the failures of %d pieces from state: %s", len(forgotten), err)
+	}
 }
 
-func (cl *Client) GetAmountWaitingForProposal() int {
-	cl.WaitingForProposalMutex.Lock()
-	defer cl.WaitingForProposalMutex.Unlock()
-
-	return len(cl.WaitingForProposal)
+// failReservation marks a deal that is waiting for its proposal as failed, making space for other deals
+func (cl *Client) failReservation(pieceCid string, reason string) {
+	d := cl.GetDeal(pieceCid)
+	if d == nil || d.State != deal.Reserved {
+		return
+	}
+	err := cl.TransitionDeal(pieceCid, deal.Failed, reason)
+	if err != nil {
+		log.Warnf("Could not mark deal %s as failed: %s", pieceCid, err)
+	}
 }
 
-func (cl *Client) AddWaitingForProposal(proposalID string) {
-	cl.WaitingForProposalMutex.Lock()
-	defer cl.WaitingForProposalMutex.Unlock()
+// expireReservations fails the deals that have been waiting for their proposal longer than the reservation TTL,
+// and that have no pending proposal. Their failure may have dropped out of the recent failures before we saw it.
+func (cl *Client) expireReservations(pendingProposals []spadeclient.DealProposal) {
+	if cl.Configuration.ReservationTTL <= 0 {
+		return
+	}
+	pending := make(map[string]bool)
+	for _, proposal := range pendingProposals {
+		pending[proposal.PieceCid] = true
+	}
 
-	cl.WaitingForProposal[proposalID] = true
+	cl.DealsMutex.Lock()
+	defer cl.DealsMutex.Unlock()
+	for _, d := range cl.Deals {
+		if d.State != deal.Reserved || pending[d.PieceCid] {
+			continue
+		}
+		if age := time.Since(d.CreatedAt); age > cl.Configuration.ReservationTTL {
+			log.Warnf(" > Giving up on the reservation of %s, no proposal after %s", d.PieceCid, age.Round(time.Minute))
+			cl.abandonDeal(d, fmt.Sprintf("no proposal within %s of the reservation", cl.Configuration.ReservationTTL))
+		}
+	}
 }
 
-func (cl *Client) RemoveWaitingForProposal(proposalID string) {
-	cl.WaitingForProposalMutex.Lock()
-	defer cl.WaitingForProposalMutex.Unlock()
-
-	delete(cl.WaitingForProposal, proposalID)
+// cancelReservation cancels a deal that is waiting for its proposal
+func (cl *Client) cancelReservation(pieceCid string, reason string) {
+	d := cl.GetDeal(pieceCid)
+	if d == nil || d.State != deal.Reserved {
+		return
+	}
+	err := cl.TransitionDeal(pieceCid, deal.Cancelled, reason)
+	if err != nil {
+		log.Warnf("Could not cancel deal %s: %s", pieceCid, err)
+	}
 }
 
 func (cl *Client) HandleDeal(ctx context.Context, proposal spadeclient.DealProposal) {
-	// check if we're already handling this deal
-	cl.ActiveDealsMutex.Lock()
-	if _, ok := cl.ActiveDeals[proposal.ProposalID]; ok {
-		cl.ActiveDealsMutex.Unlock()
-		//log.Debugf("Already handling deal %s", proposal.ProposalID)
+	// check if we're not already handling, or maybe already imported this deal
+	if !cl.claimDeal(proposal) {
 		return
 	}
 
-	// check if it maybe already was imported
-	if cl.IsAlreadyImported(proposal.ProposalID) {
-		cl.ActiveDealsMutex.Unlock()
-		//log.Debugf("Already imported deal %s", proposal.ProposalID)
+	cl.processDeal(ctx, proposal, false)
+}
+
+// processDeal drives a claimed deal to the import, continuing from whatever state the deal is in. Downloads only
+// run in a download slot, which the caller may already hold; the slot is released as soon as the download is done.
+func (cl *Client) processDeal(ctx context.Context, proposal spadeclient.DealProposal, hasDownloadSlot bool) {
+	d := cl.GetDeal(proposal.PieceCid)
+	if d == nil {
+		log.Warnf("Stopped handling deal %s: unknown piece %s", proposal.ProposalID, proposal.PieceCid)
+		if hasDownloadSlot {
+			cl.releaseDownloadSlot()
+		}
 		return
 	}
 
-	// Now check if we're not doing too many deals
-	if len(cl.ActiveDeals) > cl.Configuration.MaxSpadeDealsActive {
-		cl.ActiveDealsMutex.Unlock()
-		//log.Debugf("Already handling %d deals - backing off from handling %s", len(cl.ActiveDeals), proposal.ProposalID)
-		return
+	outFilename := d.Filename
+	switch d.State {
+	case deal.ProposalSeen, deal.ManifestFetched, deal.Downloading:
+		if !hasDownloadSlot && !cl.acquireDownloadSlot(ctx) {
+			return
+		}
+		var ok bool
+		outFilename, ok = cl.downloadDeal(ctx, proposal)
+		cl.releaseDownloadSlot()
+		if !ok {
+			return
+		}
+	default:
+		if hasDownloadSlot {
+			cl.releaseDownloadSlot()
+		}
 	}
 
-	cl.ActiveDeals[proposal.ProposalID] = &proposal
-	cl.ActiveDealsMutex.Unlock()
+	cl.importDeal(ctx, proposal, outFilename)
+}
 
+func (cl *Client) downloadDeal(ctx context.Context, proposal spadeclient.DealProposal) (string, bool) {
 	retry := 0
 handleDeal:
 	if retry > 10 {
 		log.Errorf("Could not handle deal %s! Giving up.", proposal.ProposalID)
-		cl.ActiveDealsMutex.Lock()
-		delete(cl.ActiveDeals, proposal.ProposalID)
-		cl.ActiveDealsMutex.Unlock()
-		return
+		cl.failDeal(proposal, "could not fetch manifest")
+		return "", false
 	}
 
 	log.Infof("Fetching manifest for %s", proposal.ProposalID)
@@ -313,36 +656,207 @@ handleDeal:
 		goto handleDeal
 	}
 
-	outFilename := fmt.Sprintf("%s/%s", cl.Configuration.DownloadPath, manifest.FRC58CommP.PCidV2())
-	log.Debugf("Found %d segments, starting download and assembly (%s)", len(manifest.PieceList), outFilename)
+	outFilename := cl.downloadFilename(proposal.PieceCid, fmt.Sprintf("%s", manifest.FRC58CommP.PCidV2()))
+	err = cl.UpdateDeal(proposal.PieceCid, func(d *deal.Deal) error {
+		d.Root = filepath.Dir(outFilename)
+		d.Filename = outFilename
+		if d.State == deal.ProposalSeen {
+			return d.Transition(deal.ManifestFetched, fmt.Sprintf("%d segments", len(manifest.PieceList)))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Could not update deal %s: %s", proposal.ProposalID, err)
+		return "", false
+	}
+
+	if cl.GetDeal(proposal.PieceCid).State == deal.Downloading {
+		// The assembler picks up the segments that are already in place
+		log.Infof("Resuming download and assembly of %d segments (%s)", len(manifest.PieceList), outFilename)
+	} else {
+		log.Debugf("Found %d segments, starting download and assembly (%s)", len(manifest.PieceList), outFilename)
+		if !cl.transitionDeal(proposal, deal.Downloading, "") {
+			return "", false
+		}
+	}
+
+	// A file in the download root is complete, e.g. when we stopped right after moving it into place
+	staged := stagingFilename(outFilename)
+	filename := outFilename
+	if _, err := os.Stat(outFilename); err == nil {
+		log.Infof(" > Found a complete download of %s (%s)", proposal.ProposalID, outFilename)
+	} else if cl.restoreFromCache(proposal, outFilename) {
+		log.Infof(" > Reused %s from the piece cache (%s)", proposal.PieceCid, outFilename)
+	} else {
+		filename = staged
+		if !cl.download(ctx, proposal, manifest, staged) {
+			return "", false
+		}
+	}
+
+	if cl.Configuration.VerifyDownloads && !cl.verifyDownload(proposal, filename, manifest.FRC58CommP.PCidV2()) {
+		return "", false
+	}
+	if filename == staged {
+		err = promoteDownload(outFilename)
+		if err != nil {
+			log.Warnf("Could not complete the download of %s: %s", proposal.ProposalID, err)
+			cl.failDeal(proposal, err.Error())
+			return "", false
+		}
+	}
+	if cl.PieceCache != nil && cl.Configuration.VerifyDownloads {
+		// Only verified pieces go in the cache
+		err = cl.PieceCache.Add(proposal.PieceCid, outFilename)
+		if err != nil {
+			log.Warnf("Could not cache %s: %s", proposal.PieceCid, err)
+		}
+	}
+	if !cl.transitionDeal(proposal, deal.Downloaded, "") {
+		return "", false
+	}
+	return outFilename, true
+}
+
+// restoreFromCache puts the piece of a deal from the piece cache in the download root
+func (cl *Client) restoreFromCache(proposal spadeclient.DealProposal, outFilename string) bool {
+	if cl.PieceCache == nil {
+		return false
+	}
+	staged := stagingFilename(outFilename)
+	err := os.MkdirAll(filepath.Dir(staged), 0o755)
+	if err != nil {
+		log.Warnf("Could not create the staging directory for %s: %s", proposal.ProposalID, err)
+		return false
+	}
+	ok, err := cl.PieceCache.Restore(proposal.PieceCid, staged)
+	if err != nil {
+		log.Warnf("Could not reuse the cached piece for %s, downloading it: %s", proposal.ProposalID, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	err = promoteDownload(outFilename)
+	if err != nil {
+		log.Warnf("Could not reuse the cached piece for %s, downloading it: %s", proposal.ProposalID, err)
+		return false
+	}
+	return true
+}
 
-	// Check if we already have an active download for this source
-	err = manifest.StartDownload(ctx, outFilename, true, 50, 60*10, false, 5)
+// download writes the piece of a deal to the staging file, continuing where an earlier attempt left off
+func (cl *Client) download(ctx context.Context, proposal spadeclient.DealProposal, manifest *fildatasegment.Agg, staged string) bool {
+	// Make sure the download fits next to the other deals we have going on
+	root, ok := cl.rootFor(finalFilename(staged))
+	if !ok {
+		root = config.DownloadRoot{Path: downloadRoot(staged)}
+	}
+	available, err := cl.rootAvailable(root, proposal.PieceCid)
+	if err != nil {
+		log.Warnf("Could not check the free space in %s: %s", root.Path, err)
+	} else if needed := remainingDiskUsage(cl.GetDeal(proposal.PieceCid)); needed > available {
+		log.Warnf("Not enough space to download %s: need %s, %s available", proposal.ProposalID, humanize.IBytes(needed), humanize.IBytes(available))
+		cl.failDeal(proposal, fmt.Sprintf("not enough disk space: need %s, %s available", humanize.IBytes(needed), humanize.IBytes(available)))
+		return false
+	}
+
+	err = os.MkdirAll(filepath.Dir(staged), 0o755)
+	if err != nil {
+		log.Warnf("Could not create the staging directory for %s: %s", proposal.ProposalID, err)
+		cl.failDeal(proposal, fmt.Sprintf("could not create the staging directory: %s", err))
+		return false
+	}
+
+	started := time.Now()
+	existing := fileSize(staged)
+	job := downloader.Job{
+		ProposalID: proposal.ProposalID,
+		PieceCid:   proposal.PieceCid,
+		PieceCidV2: filepath.Base(staged),
+		Manifest:   manifest,
+		Sources:    cl.Sources.Order(cl.GetDeal(proposal.PieceCid).Sources),
+		Filename:   staged,
+		Settings:   cl.Configuration.DownloadConfig.ForTenant(proposal.TenantID),
+	}
+	backend := downloader.Select(cl.Configuration.DownloadConfig, proposal.TenantID, job.Sources)
+	segments := 1
+	if backend == downloader.BackendAssembler {
+		segments = len(manifest.PieceList)
+		// The assembler tries the sources of a segment in order, put the hosts we prefer first
+		for i := range manifest.PieceList {
+			manifest.PieceList[i].Sources = cl.Sources.Order(manifest.PieceList[i].Sources)
+		}
+	}
+	log.Debugf("Downloading %s with the %s backend, %d parallel segments, a timeout of %s and %d retries", proposal.ProposalID, backend, job.Settings.Parallelism, job.Settings.Timeout, job.Settings.Retries)
+	downloadCtx, stopTracking := cl.downloadContext(ctx, proposal, segments)
+	err = cl.Downloaders[backend].Download(downloadCtx, job)
+	tracked := cl.trackedBytes(proposal.PieceCid)
+	stopTracking()
+	if written := fileSize(staged) - existing; err == nil && (backend == downloader.BackendAssembler || backend == downloader.BackendHttp) && written > 0 && tracked == 0 {
+		log.Warnf("The %s backend wrote %s for %s without passing our HTTP transport: bandwidth limits, progress and source tracking do not apply to it", backend, humanize.IBytes(uint64(written)), proposal.ProposalID)
+	}
+	cl.persist(statsBucket, sourcesKey, cl.Sources.Stats())
 	if err != nil {
 		log.Infof("Download errored %s (%s) - stopping and removing", proposal.ProposalID, err.Error())
+		cl.failDeal(proposal, fmt.Sprintf("download failed: %s", err))
+		return false
+	}
+	cl.recordDownload(fileSize(staged)-existing, time.Since(started))
+	log.Infof(" > Download handler done for %s", proposal.ProposalID)
+	return true
+}
+
+// downloadContext returns the context for the download of a proposal, the requests made with it are limited and
+// tracked by our transport until the download is stopped
+func (cl *Client) downloadContext(ctx context.Context, proposal spadeclient.DealProposal, segments int) (context.Context, func()) {
+	return cl.trackDownload(cl.Sources.WithDownload(cl.Bandwidth.WithDeal(ctx)), proposal.PieceCid, proposal.ProposalID, segments, uint64(proposal.PieceSize))
+}
 
-		// remove from actual list
-		cl.ActiveDealsMutex.Lock()
-		delete(cl.ActiveDeals, proposal.ProposalID)
-		cl.ActiveDealsMutex.Unlock()
+func (cl *Client) importDeal(ctx context.Context, proposal spadeclient.DealProposal, outFilename string) {
+	// Wait for our turn, Boost doesn't like too many imports at once
+	select {
+	case cl.importSlots <- struct{}{}:
+	case <-ctx.Done():
 		return
 	}
-	log.Infof(" > Download handler done for %s", proposal.ProposalID)
+	defer func() { <-cl.importSlots }()
 
-	err = cl.BoostClient.ImportDeal(ctx, &proposal, outFilename)
+	if cl.GetDeal(proposal.PieceCid).State != deal.Importing {
+		if !cl.transitionDeal(proposal, deal.Importing, "") {
+			return
+		}
+	}
+
+	started := time.Now()
+	err := cl.BoostClient.ImportDeal(ctx, &proposal, outFilename)
 	if err != nil {
 		log.Warnf("Failure importing boost deal %s: %s", proposal.ProposalID, err)
+		cl.failDeal(proposal, fmt.Sprintf("import failed: %s", err))
+		return
+	}
+	cl.recordImport(time.Since(started))
+	if !cl.transitionDeal(proposal, deal.Imported, "") {
 		return
 	}
 
-	// remove from actual list
-	cl.ActiveDealsMutex.Lock()
-	delete(cl.ActiveDeals, proposal.ProposalID)
-	cl.ActiveDealsMutex.Unlock()
+	log.Infof("Successfully downloaded and imported %s", proposal.ProposalID)
+}
 
-	// also add to imported list
-	cl.AddImported(proposal.ProposalID)
+// transitionDeal moves the deal of a proposal we are handling to a new state. When this fails (e.g. because
+// the deal got cancelled in the meantime) the caller should stop handling the deal.
+func (cl *Client) transitionDeal(proposal spadeclient.DealProposal, to deal.State, reason string) bool {
+	err := cl.TransitionDeal(proposal.PieceCid, to, reason)
+	if err != nil {
+		log.Warnf("Stopped handling deal %s: %s", proposal.ProposalID, err)
+		return false
+	}
+	return true
+}
 
-	log.Infof("Successfully downloaded and imported %s", proposal.ProposalID)
-	return
+func (cl *Client) failDeal(proposal spadeclient.DealProposal, reason string) {
+	err := cl.TransitionDeal(proposal.PieceCid, deal.Failed, reason)
+	if err != nil {
+		log.Warnf("Could not mark deal %s as failed: %s", proposal.ProposalID, err)
+	}
 }
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"filecoin-spade-client/pkg/log"
+	"filecoin-spade-client/pkg/lotusclient"
+	"filecoin-spade-client/pkg/spadeclient"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	statsBucket   = "stats"
+	throughputKey = "throughput"
+	sourcesKey    = "sources"
+
+	// Weight of a new measurement in the moving averages
+	throughputSmoothing = 0.3
+)
+
+// Throughput keeps moving averages of how fast we download and import deals
+type Throughput struct {
+	DownloadBytesPerSecond float64 `json:"download_bytes_per_second"`
+	ImportSeconds          float64 `json:"import_seconds"`
+}
+
+func (cl *Client) recordDownload(bytes int64, elapsed time.Duration) {
+	if bytes <= 0 || elapsed <= 0 {
+		return
+	}
+
+	cl.ThroughputMutex.Lock()
+	defer cl.ThroughputMutex.Unlock()
+
+	rate := float64(bytes) / elapsed.Seconds()
+	if cl.Throughput.DownloadBytesPerSecond == 0 {
+		cl.Throughput.DownloadBytesPerSecond = rate
+	} else {
+		cl.Throughput.DownloadBytesPerSecond += throughputSmoothing * (rate - cl.Throughput.DownloadBytesPerSecond)
+	}
+	cl.persist(statsBucket, throughputKey, cl.Throughput)
+	log.Infof("Downloaded %s in %s (%s/s), average download speed now %s/s", humanize.IBytes(uint64(bytes)), elapsed.Round(time.Second), humanize.IBytes(uint64(rate)), humanize.IBytes(uint64(cl.Throughput.DownloadBytesPerSecond)))
+}
+
+func (cl *Client) recordImport(elapsed time.Duration) {
+	cl.ThroughputMutex.Lock()
+	defer cl.ThroughputMutex.Unlock()
+
+	if cl.Throughput.ImportSeconds == 0 {
+		cl.Throughput.ImportSeconds = elapsed.Seconds()
+	} else {
+		cl.Throughput.ImportSeconds += throughputSmoothing * (elapsed.Seconds() - cl.Throughput.ImportSeconds)
+	}
+	cl.persist(statsBucket, throughputKey, cl.Throughput)
+}
+
+// estimateDuration returns how long it will take to download, import and seal the given amount of bytes. Without
+// measurements only the sealing estimate is used.
+func (cl *Client) estimateDuration(remaining uint64) time.Duration {
+	cl.ThroughputMutex.Lock()
+	defer cl.ThroughputMutex.Unlock()
+
+	estimate := cl.Configuration.SealingDuration
+	if cl.Throughput.DownloadBytesPerSecond > 0 {
+		estimate += time.Duration(float64(remaining) / cl.Throughput.DownloadBytesPerSecond * float64(time.Second))
+	}
+	estimate += time.Duration(cl.Throughput.ImportSeconds * float64(time.Second))
+	return estimate
+}
+
+// checkDeadline returns why the proposal can not be finished before its start, or an empty string when it can
+func (cl *Client) checkDeadline(proposal spadeclient.DealProposal) string {
+	remaining := uint64(proposal.PieceSize)
+	if d := cl.GetDeal(proposal.PieceCid); d != nil && d.ProposalID == proposal.ProposalID {
+		remaining = remainingDiskUsage(d)
+	}
+
+	deadline := proposalDeadline(proposal)
+	if time.Now().Add(cl.estimateDuration(remaining)).After(deadline) {
+		return fmt.Sprintf("can not be downloaded, imported and sealed before the deal starts at %s", deadline.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// proposalDeadline returns the moment the deal has to be sealed
+func proposalDeadline(proposal spadeclient.DealProposal) time.Time {
+	if !proposal.StartTime.IsZero() {
+		return proposal.StartTime
+	}
+	return time.Unix(lotusclient.GenesisTimestamp+proposal.StartEpoch*lotusclient.EpochDuration, 0)
+}
+
+// sortByDeadline orders the proposals earliest deadline first
+func sortByDeadline(proposals []spadeclient.DealProposal) {
+	sort.SliceStable(proposals, func(i, j int) bool {
+		return proposalDeadline(proposals[i]).Before(proposalDeadline(proposals[j]))
+	})
+}
+
+func fileSize(filename string) int64 {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"filecoin-spade-client/pkg/deal"
+	"filecoin-spade-client/pkg/log"
+	"filecoin-spade-client/pkg/spadeclient"
+	"filecoin-spade-client/pkg/state"
+	"golang.org/x/xerrors"
+)
+
+const dealsBucket = "deals"
+
+// downloadStates are the states of deals that are (about to start) downloading
+var downloadStates = []deal.State{deal.ProposalSeen, deal.ManifestFetched, deal.Downloading}
+
+func (cl *Client) loadDeals(tx *state.Tx) error {
+	cl.DealsMutex.Lock()
+	defer cl.DealsMutex.Unlock()
+
+	for _, pieceCid := range tx.Keys(dealsBucket) {
+		d := new(deal.Deal)
+		if _, err := tx.Get(dealsBucket, pieceCid, d); err != nil {
+			return err
+		}
+		cl.Deals[pieceCid] = d
+	}
+	return nil
+}
+
+// GetDeal returns a copy of the deal for the given piece, or nil when we don't know the piece
+func (cl *Client) GetDeal(pieceCid string) *deal.Deal {
+	cl.DealsMutex.Lock()
+	defer cl.DealsMutex.Unlock()
+
+	if d, ok := cl.Deals[pieceCid]; ok {
+		dealCopy := *d
+		return &dealCopy
+	}
+	return nil
+}
+
+// FindDealByProposal returns a copy of the deal belonging to the given proposal, or nil when there is none
+func (cl *Client) FindDealByProposal(proposalID string) *deal.Deal {
+	cl.DealsMutex.Lock()
+	defer cl.DealsMutex.Unlock()
+
+	for _, d := range cl.Deals {
+		if d.ProposalID == proposalID {
+			dealCopy := *d
+			return &dealCopy
+		}
+	}
+	return nil
+}
+
+// CountDeals returns the amount of deals in any of the given states
+func (cl *Client) CountDeals(states ...deal.State) int {
+	cl.DealsMutex.Lock()
+	defer cl.DealsMutex.Unlock()
+
+	return cl.countDeals(states...)
+}
+
+func (cl *Client) countDeals(states ...deal.State) int {
+	count := 0
+	for _, d := range cl.Deals {
+		for _, s := range states {
+			if d.State == s {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+func (cl *Client) CountActiveDeals() int {
+	cl.DealsMutex.Lock()
+	defer cl.DealsMutex.Unlock()
+
+	return cl.countActiveDeals()
+}
+
+func (cl *Client) countActiveDeals() int {
+	count := 0
+	for _, d := range cl.Deals {
+		if d.IsActive() {
+			count++
+		}
+	}
+	return count
+}
+
+// ReserveDeal starts tracking a freshly reserved piece
+func (cl *Client) ReserveDeal(piece *spadeclient.Piece) {
+	root := cl.placeDeal(piece.PieceCid, piece.PaddedPieceSize)
+
+	cl.DealsMutex.Lock()
+	defer cl.DealsMutex.Unlock()
+
+	if d, ok := cl.Deals[piece.PieceCid]; ok && !d.IsFinal() && d.State != deal.Failed {
+		log.Warnf("Reserved piece %s which is already %s", piece.PieceCid, d.State)
+		return
+	}
+
+	d := deal.New(piece.PieceCid, piece.PaddedPieceSize)
+	d.Root = root
+	d.Sources = piece.Sources
+	cl.Deals[piece.PieceCid] = d
+	cl.persist(dealsBucket, piece.PieceCid, d)
+	log.Debugf("Deal %s: %s in %s", piece.PieceCid, d.State, d.Root)
+}
+
+// TransitionDeal moves the deal of the given piece to a new state and persists it
+func (cl *Client) TransitionDeal(pieceCid string, to deal.State, reason string) error {
+	return cl.UpdateDeal(pieceCid, func(d *deal.Deal) error {
+		return d.Transition(to, reason)
+	})
+}
+
+// UpdateDeal applies fn to the deal of the given piece and persists the result when fn succeeds
+func (cl *Client) UpdateDeal(pieceCid string, fn func(d *deal.Deal) error) error {
+	cl.DealsMutex.Lock()
+	defer cl.DealsMutex.Unlock()
+
+	d, ok := cl.Deals[pieceCid]
+	if !ok {
+		return xerrors.Errorf("unknown deal for piece %s", pieceCid)
+	}
+
+	return cl.updateDeal(d, fn)
+}
+
+func (cl *Client) updateDeal(d *deal.Deal, fn func(d *deal.Deal) error) error {
+	from := d.State
+	updated := *d
+	err := fn(&updated)
+	if err != nil {
+		return err
+	}
+	*d = updated
+
+	if from != d.State {
+		if d.Reason != "" {
+			log.Debugf("Deal %s (proposal %s): %s -> %s (%s)", d.PieceCid, d.ProposalID, from, d.State, d.Reason)
+		} else {
+			log.Debugf("Deal %s (proposal %s): %s -> %s", d.PieceCid, d.ProposalID, from, d.State)
+		}
+	}
+	cl.persist(dealsBucket, d.PieceCid, d)
+	return nil
+}
+
+// claimDeal marks the deal of the proposal as seen, unless it is already being handled or imported. Returns whether
+// the caller should handle the deal.
+func (cl *Client) claimDeal(proposal spadeclient.DealProposal) bool {
+	cl.DealsMutex.Lock()
+	defer cl.DealsMutex.Unlock()
+
+	d, ok := cl.Deals[proposal.PieceCid]
+	if ok && d.ProposalID != proposal.ProposalID && (d.IsFinal() || d.State == deal.Failed) {
+		// A new proposal for a piece we dealt with before (or whose reservation was cancelled), start over
+		ok = false
+	}
+	if !ok {
+		d = deal.New(proposal.PieceCid, uint64(proposal.PieceSize))
+		cl.Deals[proposal.PieceCid] = d
+		cl.persist(dealsBucket, d.PieceCid, d)
+	}
+
+	if d.IsActive() || d.IsFinal() {
+		return false
+	}
+
+	err := cl.updateDeal(d, func(d *deal.Deal) error {
+		d.ProposalID = proposal.ProposalID
+		d.Proposal = &proposal
+		d.PieceSize = uint64(proposal.PieceSize)
+		return d.Transition(deal.ProposalSeen, "")
+	})
+	if err != nil {
+		log.Warnf("Could not claim deal %s: %s", proposal.ProposalID, err)
+		return false
+	}
+	return true
+}
+
+// skipProposal marks the deal of a proposal we are not going to handle as failed. Returns false when the deal was
+// already skipped for the same reason.
+func (cl *Client) skipProposal(proposal spadeclient.DealProposal, reason string) bool {
+	cl.DealsMutex.Lock()
+	defer cl.DealsMutex.Unlock()
+
+	d, ok := cl.Deals[proposal.PieceCid]
+	if !ok || (d.ProposalID != proposal.ProposalID && (d.IsFinal() || d.State == deal.Failed)) {
+		d = deal.New(proposal.PieceCid, uint64(proposal.PieceSize))
+		cl.Deals[proposal.PieceCid] = d
+	}
+	if d.IsActive() || d.IsFinal() || (d.State == deal.Failed && d.Reason == reason) {
+		return false
+	}
+
+	log.Warnf("Skipping deal %s (%s): %s", proposal.ProposalID, proposal.PieceCid, reason)
+	err := cl.updateDeal(d, func(d *deal.Deal) error {
+		d.ProposalID = proposal.ProposalID
+		d.Proposal = &proposal
+		if d.State == deal.Failed {
+			d.Reason = reason
+			return nil
+		}
+		return d.Transition(deal.Failed, reason)
+	})
+	if err != nil {
+		log.Warnf("Could not mark deal %s as skipped: %s", proposal.ProposalID, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"filecoin-spade-client/pkg/config"
+	"filecoin-spade-client/pkg/deal"
+	"filecoin-spade-client/pkg/diskspace"
+	"filecoin-spade-client/pkg/log"
+	"github.com/dustin/go-humanize"
+	"os"
+	"path/filepath"
+)
+
+// dealRoot returns the download root a deal is placed in, or an empty string when it isn't placed yet
+func dealRoot(d *deal.Deal) string {
+	if d.Root != "" {
+		return d.Root
+	}
+	if d.Filename != "" {
+		return filepath.Dir(d.Filename)
+	}
+	return ""
+}
+
+// pendingDiskUsage returns how many bytes the reserved and downloading deals, except the given piece, are still
+// going to write to the download root. Deals that are not placed yet count for every root. Pieces are accounted
+// for with their padded size.
+func (cl *Client) pendingDiskUsage(root string, exceptPieceCid string) uint64 {
+	cl.DealsMutex.Lock()
+	defer cl.DealsMutex.Unlock()
+
+	pending := uint64(0)
+	for _, d := range cl.Deals {
+		if d.PieceCid == exceptPieceCid {
+			continue
+		}
+		if placed := dealRoot(d); placed != "" && placed != root {
+			continue
+		}
+		switch d.State {
+		case deal.Reserved, deal.ProposalSeen, deal.ManifestFetched, deal.Downloading:
+			pending += remainingDiskUsage(d)
+		}
+	}
+	return pending
+}
+
+// remainingDiskUsage returns how many bytes a deal still needs, taking into account what is already downloaded
+func remainingDiskUsage(d *deal.Deal) uint64 {
+	if d.Filename == "" {
+		return d.PieceSize
+	}
+	info, err := os.Stat(d.Filename)
+	if err != nil {
+		info, err = os.Stat(stagingFilename(d.Filename))
+	}
+	if err != nil {
+		return d.PieceSize
+	}
+	if uint64(info.Size()) >= d.PieceSize {
+		return 0
+	}
+	return d.PieceSize - uint64(info.Size())
+}
+
+// usedDiskSpace returns how many bytes the files in a download root take up, including staged and quarantined
+// files
+func usedDiskSpace(path string) uint64 {
+	used := uint64(0)
+	for _, dir := range []string{path, filepath.Join(path, stagingDir), filepath.Join(path, quarantineDir)} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && !entry.IsDir() {
+				used += uint64(info.Size())
+			}
+		}
+	}
+	return used
+}
+
+// rootAvailable returns how many bytes in a download root are not yet claimed by other deals, keeping the
+// configured reserve free and staying within the capacity of the root
+func (cl *Client) rootAvailable(root config.DownloadRoot, exceptPieceCid string) (uint64, error) {
+	free, err := diskspace.Free(root.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	pending := cl.pendingDiskUsage(root.Path, exceptPieceCid)
+	claimed := pending + cl.Configuration.DownloadSpaceReserve
+	if free < claimed {
+		return 0, nil
+	}
+	available := free - claimed
+
+	if root.Capacity > 0 {
+		used := usedDiskSpace(root.Path) + pending
+		if used >= root.Capacity {
+			return 0, nil
+		}
+		available = min(available, root.Capacity-used)
+	}
+	return available, nil
+}
+
+// availableDiskSpace returns the most bytes available in a single download root, which is the largest piece we
+// can take on next
+func (cl *Client) availableDiskSpace(exceptPieceCid string) (uint64, error) {
+	most := uint64(0)
+	for _, root := range cl.Configuration.Roots() {
+		available, err := cl.rootAvailable(root, exceptPieceCid)
+		if err != nil {
+			return 0, err
+		}
+		log.Debugf("%s available in %s", humanize.IBytes(available), root.Path)
+		most = max(most, available)
+	}
+	return most, nil
+}
+
+// placeDeal picks the download root for a piece, using the configured placement. When the piece fits nowhere,
+// the root with the most available space is returned.
+func (cl *Client) placeDeal(pieceCid string, pieceSize uint64) string {
+	roots := cl.Configuration.Roots()
+	available := make([]uint64, len(roots))
+	best := 0
+	for i, root := range roots {
+		var err error
+		available[i], err = cl.rootAvailable(root, pieceCid)
+		if err != nil {
+			log.Warnf("Could not check the free space in %s: %s", root.Path, err)
+			continue
+		}
+		if available[i] > available[best] {
+			best = i
+		}
+	}
+
+	if cl.Configuration.DownloadPlacement == config.PlaceRoundRobin {
+		cl.placementMutex.Lock()
+		defer cl.placementMutex.Unlock()
+		for i := range roots {
+			next := (cl.nextRoot + i) % len(roots)
+			if available[next] >= pieceSize {
+				cl.nextRoot = next + 1
+				return roots[next].Path
+			}
+		}
+	}
+	return roots[best].Path
+}
+
+// rootFor returns the configured download root holding the file
+func (cl *Client) rootFor(filename string) (config.DownloadRoot, bool) {
+	for _, root := range cl.Configuration.Roots() {
+		if filepath.Dir(filename) == root.Path {
+			return root, true
+		}
+	}
+	return config.DownloadRoot{}, false
+}
+
+// findDownload looks for an earlier download of the file in the download roots, complete or still in the
+// staging directory, and returns where it ends up when complete
+func (cl *Client) findDownload(name string) string {
+	for _, root := range cl.Configuration.Roots() {
+		filename := filepath.Join(root.Path, name)
+		if _, err := os.Stat(filename); err == nil {
+			return filename
+		}
+		if _, err := os.Stat(stagingFilename(filename)); err == nil {
+			return filename
+		}
+	}
+	return ""
+}
+
+// downloadFilename returns where a piece is downloaded to: where an earlier download of it is, or else in the
+// download root the deal is placed in
+func (cl *Client) downloadFilename(pieceCid string, name string) string {
+	if existing := cl.findDownload(name); existing != "" {
+		return existing
+	}
+
+	d := cl.GetDeal(pieceCid)
+	if d == nil {
+		return filepath.Join(cl.placeDeal(pieceCid, 0), name)
+	}
+	if _, ok := cl.rootFor(filepath.Join(d.Root, name)); ok {
+		return filepath.Join(d.Root, name)
+	}
+	return filepath.Join(cl.placeDeal(pieceCid, d.PieceSize), name)
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"filecoin-spade-client/pkg/deal"
+	"filecoin-spade-client/pkg/log"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Boost checkpoints after which the piece is in a sector, and Boost doesn't need the file anymore
+var sealedCheckpoints = map[string]bool{
+	"AddedPiece":          true,
+	"IndexedAndAnnounced": true,
+	"Complete":            true,
+}
+
+// collectGarbage periodically removes the files in the download path that are no longer needed
+func (cl *Client) collectGarbage(ctx context.Context) {
+	if cl.Configuration.GCInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cl.Configuration.GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		cl.removeGarbage(ctx)
+		cl.pruneDeals()
+	}
+}
+
+// pruneDeals forgets the deals that are done with for longer than the retention period, so the state doesn't grow
+// forever. Deals that still have a file are kept, the file would otherwise no longer belong to a deal.
+func (cl *Client) pruneDeals() {
+	if cl.Configuration.DealRetention <= 0 {
+		return
+	}
+
+	var pruned []string
+	cl.DealsMutex.Lock()
+	for pieceCid, d := range cl.Deals {
+		if !d.IsFinal() && d.State != deal.Failed {
+			continue
+		}
+		if time.Since(d.UpdatedAt) < cl.Configuration.DealRetention {
+			continue
+		}
+		if d.Filename != "" && (fileExists(d.Filename) || fileExists(stagingFilename(d.Filename))) {
+			continue
+		}
+		delete(cl.Deals, pieceCid)
+		pruned = append(pruned, pieceCid)
+	}
+	cl.DealsMutex.Unlock()
+
+	for _, pieceCid := range pruned {
+		cl.forget(dealsBucket, pieceCid)
+	}
+	if len(pruned) > 0 {
+		log.Infof(" > Forgot %d deals that were done with more than %s ago", len(pruned), cl.Configuration.DealRetention)
+	}
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// removeGarbage removes the files of failed, cancelled and sealed deals from the download path, including partial
+// downloads in the staging directory, and quarantined files after the grace period. Files that don't belong to a
+// deal are left alone. In dry run mode it only logs what it would remove.
+func (cl *Client) removeGarbage(ctx context.Context) {
+	owners := make(map[string]*deal.Deal)
+	cl.DealsMutex.Lock()
+	for _, d := range cl.Deals {
+		if d.Filename != "" {
+			c := *d
+			owners[d.Filename] = &c
+		}
+	}
+	cl.DealsMutex.Unlock()
+
+	var dirs []string
+	for _, root := range cl.Configuration.Roots() {
+		dirs = append(dirs, root.Path, filepath.Join(root.Path, stagingDir), filepath.Join(root.Path, quarantineDir))
+	}
+
+	log.Infof("Collecting garbage in the download roots")
+	removed := uint64(0)
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warnf(" > Could not list %s: %s", dir, err)
+			}
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			filename := filepath.Join(dir, entry.Name())
+
+			reason := ""
+			if filepath.Base(dir) == quarantineDir {
+				reason = cl.quarantineGarbage(info)
+			} else if owner, ok := owners[finalFilename(filename)]; ok {
+				reason = cl.dealGarbage(ctx, owner)
+			} else {
+				log.Debugf(" > Leaving %s alone, it does not belong to a deal", filename)
+			}
+			if reason == "" {
+				continue
+			}
+
+			if cl.Configuration.GCDryRun {
+				log.Infof(" > Would remove %s (%s, %s)", filename, humanize.IBytes(uint64(info.Size())), reason)
+				continue
+			}
+			err = os.Remove(filename)
+			if err != nil {
+				log.Warnf(" > Could not remove %s: %s", filename, err)
+				continue
+			}
+			log.Infof(" > Removed %s (%s, %s)", filename, humanize.IBytes(uint64(info.Size())), reason)
+			removed += uint64(info.Size())
+		}
+	}
+	if removed > 0 {
+		log.Infof(" > Freed %s", humanize.IBytes(removed))
+	}
+}
+
+// quarantineGarbage returns why a quarantined file can be removed, or an empty string if it should be kept
+func (cl *Client) quarantineGarbage(info os.FileInfo) string {
+	if age := time.Since(info.ModTime()); age > cl.Configuration.GCGracePeriod {
+		return fmt.Sprintf("quarantined %s ago", age.Round(time.Minute))
+	}
+	return ""
+}
+
+// dealGarbage returns why the file of a deal can be removed, or an empty string if it should be kept
+func (cl *Client) dealGarbage(ctx context.Context, d *deal.Deal) string {
+	switch d.State {
+	case deal.Failed, deal.Cancelled:
+		// Keep the partial download for a while, a new proposal for the piece picks up where we left off
+		if age := time.Since(d.UpdatedAt); age > cl.Configuration.GCGracePeriod {
+			return fmt.Sprintf("deal %s %s ago", d.State, age.Round(time.Minute))
+		}
+	case deal.Imported:
+		boostDeal, err := cl.BoostClient.GetBoostDeal(ctx, d.ProposalID)
+		if err != nil {
+			log.Warnf(" > Could not check deal %s in Boost, keeping %s: %s", d.ProposalID, d.Filename, err)
+			return ""
+		}
+		if boostDeal == nil {
+			log.Debugf(" > Boost does not know deal %s, keeping %s", d.ProposalID, d.Filename)
+			return ""
+		}
+		if boostDeal.Err != "" {
+			return fmt.Sprintf("deal failed in Boost: %s", boostDeal.Err)
+		}
+		if sealedCheckpoints[boostDeal.Checkpoint] {
+			return fmt.Sprintf("deal reached %s in Boost", boostDeal.Checkpoint)
+		}
+	}
+	return ""
+}
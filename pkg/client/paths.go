@@ -0,0 +1,40 @@
+package client
+
+import (
+	"context"
+	"filecoin-spade-client/pkg/log"
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+	"os"
+	"path/filepath"
+)
+
+const markerPrefix = ".spade-client-marker-"
+
+// checkBoostPaths makes sure Boost can open the files in the download roots under the paths we hand it, by
+// writing a marker file in every root and having Boost open it through the path mappings
+func (cl *Client) checkBoostPaths(ctx context.Context) error {
+	for _, root := range cl.Configuration.Roots() {
+		marker := filepath.Join(root.Path, markerPrefix+uuid.NewString())
+		err := os.WriteFile(marker, []byte("written by the spade client to check the path Boost sees it as\n"), 0o644)
+		if err != nil {
+			return xerrors.Errorf("could not write marker file in %s: %w", root.Path, err)
+		}
+
+		boostPath := cl.Configuration.BoostConfig.BoostPath(marker)
+		exists, ok := cl.BoostClient.CanOpen(ctx, boostPath)
+		if err := os.Remove(marker); err != nil {
+			log.Warnf("Could not remove marker file %s: %s", marker, err)
+		}
+
+		switch {
+		case !ok:
+			log.Warnf("Could not check whether Boost can open the files in %s as %s", root.Path, filepath.Dir(boostPath))
+		case !exists:
+			return xerrors.Errorf("Boost can not open the files in %s as %s, check the Boost path mappings", root.Path, filepath.Dir(boostPath))
+		default:
+			log.Infof("Boost opens the files in %s as %s", root.Path, filepath.Dir(boostPath))
+		}
+	}
+	return nil
+}
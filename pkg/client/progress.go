@@ -0,0 +1,185 @@
+package client
+
+import (
+	"context"
+	"filecoin-spade-client/pkg/log"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type progressKey struct{}
+
+// DownloadProgress is a snapshot of a running download. The assembler doesn't report on its progress, so it's
+// measured from the responses it receives: every completely read response counts as a segment.
+type DownloadProgress struct {
+	PieceCid       string        `json:"piece_cid"`
+	ProposalID     string        `json:"proposal_id"`
+	SegmentsDone   int           `json:"segments_done"`
+	Segments       int           `json:"segments"`
+	Bytes          uint64        `json:"bytes"`
+	ExpectedBytes  uint64        `json:"expected_bytes"` // estimate, up to the unpadded piece size
+	BytesPerSecond uint64        `json:"bytes_per_second"`
+	ETA            time.Duration `json:"eta"`
+	Source         string        `json:"source"` // host of the latest request
+	Started        time.Time     `json:"started"`
+}
+
+func (p DownloadProgress) String() string {
+	eta := "unknown"
+	if p.ETA > 0 {
+		eta = p.ETA.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%d/%d segments, %s of ~%s at %s/s, ETA %s, from %s", p.SegmentsDone, p.Segments, humanize.IBytes(p.Bytes), humanize.IBytes(p.ExpectedBytes), humanize.IBytes(p.BytesPerSecond), eta, p.Source)
+}
+
+// downloadTracker collects the progress of a single download
+type downloadTracker struct {
+	mutex    sync.Mutex
+	progress DownloadProgress
+}
+
+func (t *downloadTracker) requested(source string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.progress.Source = source
+}
+
+func (t *downloadTracker) read(n int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.progress.Bytes += uint64(n)
+}
+
+func (t *downloadTracker) segmentDone() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.progress.SegmentsDone = min(t.progress.SegmentsDone+1, t.progress.Segments)
+}
+
+func (t *downloadTracker) snapshot() DownloadProgress {
+	t.mutex.Lock()
+	p := t.progress
+	t.mutex.Unlock()
+
+	elapsed := time.Since(p.Started)
+	if elapsed >= time.Second {
+		p.BytesPerSecond = uint64(float64(p.Bytes) / elapsed.Seconds())
+	}
+	if p.SegmentsDone > 0 {
+		// Segments are roughly the same size, which is a better estimate than the piece size
+		p.ExpectedBytes = min(p.ExpectedBytes, p.Bytes*uint64(p.Segments)/uint64(p.SegmentsDone))
+	}
+	if p.BytesPerSecond > 0 && p.ExpectedBytes > p.Bytes {
+		p.ETA = time.Duration(float64(p.ExpectedBytes-p.Bytes) / float64(p.BytesPerSecond) * float64(time.Second))
+	}
+	return p
+}
+
+// trackDownload starts tracking the progress of a download, requests made with the returned context are counted
+// towards it. The returned function stops tracking.
+func (cl *Client) trackDownload(ctx context.Context, pieceCid string, proposalID string, segments int, pieceSize uint64) (context.Context, func()) {
+	tracker := &downloadTracker{progress: DownloadProgress{
+		PieceCid:      pieceCid,
+		ProposalID:    proposalID,
+		Segments:      segments,
+		ExpectedBytes: pieceSize / 128 * 127,
+		Started:       time.Now(),
+	}}
+
+	cl.downloadsMutex.Lock()
+	cl.downloads[pieceCid] = tracker
+	cl.downloadsMutex.Unlock()
+
+	return context.WithValue(ctx, progressKey{}, tracker), func() {
+		cl.downloadsMutex.Lock()
+		delete(cl.downloads, pieceCid)
+		cl.downloadsMutex.Unlock()
+	}
+}
+
+// trackedBytes returns how many bytes of a running download passed our HTTP transport
+func (cl *Client) trackedBytes(pieceCid string) uint64 {
+	cl.downloadsMutex.Lock()
+	tracker, ok := cl.downloads[pieceCid]
+	cl.downloadsMutex.Unlock()
+	if !ok {
+		return 0
+	}
+	return tracker.snapshot().Bytes
+}
+
+// DownloadProgress returns the progress of the running downloads, oldest first
+func (cl *Client) DownloadProgress() []DownloadProgress {
+	cl.downloadsMutex.Lock()
+	var progress []DownloadProgress
+	for _, tracker := range cl.downloads {
+		progress = append(progress, tracker.snapshot())
+	}
+	cl.downloadsMutex.Unlock()
+
+	sort.Slice(progress, func(i, j int) bool { return progress[i].Started.Before(progress[j].Started) })
+	return progress
+}
+
+// reportProgress logs the progress of the running downloads at the configured interval
+func (cl *Client) reportProgress(ctx context.Context) {
+	if cl.Configuration.ProgressInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cl.Configuration.ProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		for _, p := range cl.DownloadProgress() {
+			log.Infof("Downloading %s: %s", p.ProposalID, p)
+		}
+	}
+}
+
+// progressTransport counts the responses to requests made for a tracked download
+type progressTransport struct {
+	next http.RoundTripper
+}
+
+func (t *progressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tracker, ok := req.Context().Value(progressKey{}).(*downloadTracker)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	tracker.requested(req.URL.Host)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		resp.Body = &progressBody{ReadCloser: resp.Body, tracker: tracker}
+	}
+	return resp, nil
+}
+
+type progressBody struct {
+	io.ReadCloser
+	tracker *downloadTracker
+	done    bool
+}
+
+func (b *progressBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.tracker.read(n)
+	if err == io.EOF && !b.done {
+		b.done = true
+		b.tracker.segmentDone()
+	}
+	return n, err
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"filecoin-spade-client/pkg/spadeclient"
+	"sync"
+)
+
+// ProposalQueue holds the matched proposals that are waiting for a download slot, earliest deadline first
+type ProposalQueue struct {
+	mutex    sync.Mutex
+	items    []spadeclient.DealProposal
+	capacity int
+	notify   chan struct{}
+}
+
+func NewProposalQueue(capacity int) *ProposalQueue {
+	q := new(ProposalQueue)
+	q.capacity = capacity
+	q.notify = make(chan struct{}, 1)
+	return q
+}
+
+// Replace swaps the contents of the queue for the given proposals. When there are more proposals than fit in the
+// queue, the ones with the latest deadline are dropped; they'll be offered again on the next scan.
+// Returns the amount of dropped proposals.
+func (q *ProposalQueue) Replace(proposals []spadeclient.DealProposal) int {
+	items := make([]spadeclient.DealProposal, len(proposals))
+	copy(items, proposals)
+	sortByDeadline(items)
+
+	dropped := 0
+	if len(items) > q.capacity {
+		dropped = len(items) - q.capacity
+		items = items[:q.capacity]
+	}
+
+	q.mutex.Lock()
+	q.items = items
+	q.mutex.Unlock()
+
+	if len(items) > 0 {
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	}
+	return dropped
+}
+
+// Wait waits until the queue holds a proposal. Returns false when the context is done first.
+func (q *ProposalQueue) Wait(ctx context.Context) bool {
+	for {
+		if q.Len() > 0 {
+			return true
+		}
+
+		select {
+		case <-q.notify:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// TryPop takes the proposal with the earliest deadline from the queue, if there is one
+func (q *ProposalQueue) TryPop() (spadeclient.DealProposal, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.items) == 0 {
+		return spadeclient.DealProposal{}, false
+	}
+	proposal := q.items[0]
+	q.items = q.items[1:]
+	return proposal, true
+}
+
+func (q *ProposalQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.items)
+}
+
+func (q *ProposalQueue) Capacity() int {
+	return q.capacity
+}
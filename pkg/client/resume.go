@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"filecoin-spade-client/pkg/deal"
+	"filecoin-spade-client/pkg/log"
+	"filecoin-spade-client/pkg/spadeclient"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// resumeDeals matches the deals that were in flight before a restart, and any files already in the download
+// path, against the pending proposals in Spade and the offline deals in Boost. Deals that can still be completed
+// continue where they left off, the others are marked as failed.
+func (cl *Client) resumeDeals(ctx context.Context) error {
+	log.Infof("Reconciling deals and downloads from before the restart")
+	pendingProposals, err := cl.SpadeClient.PendingProposals(ctx)
+	if err != nil {
+		return err
+	}
+	boostDeals, err := cl.BoostClient.GetBoostDeals(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Only proposals that are still pending in Spade and waiting for data in Boost can be resumed
+	accepted := make(map[string]bool)
+	for _, boostDeal := range boostDeals.Data.Deals.Deals {
+		accepted[boostDeal.ID.String()] = true
+	}
+	proposals := make(map[string]spadeclient.DealProposal)
+	for _, proposal := range pendingProposals.PendingProposals {
+		if accepted[proposal.ProposalID] {
+			proposals[proposal.ProposalID] = proposal
+		}
+	}
+
+	cl.expireReservations(pendingProposals.PendingProposals)
+
+	tracked := make(map[string]bool)
+	var resume []spadeclient.DealProposal
+
+	cl.DealsMutex.Lock()
+	for _, d := range cl.Deals {
+		if d.Filename != "" {
+			tracked[filepath.Base(d.Filename)] = true
+		}
+		if !d.IsActive() {
+			continue
+		}
+
+		proposal, ok := proposals[d.ProposalID]
+		if !ok {
+			cl.abandonDeal(d, "proposal no longer pending after a restart")
+			continue
+		}
+		delete(proposals, d.ProposalID)
+
+		if d.State == deal.Downloaded || d.State == deal.Importing {
+			if _, err := os.Stat(d.Filename); err != nil {
+				cl.abandonDeal(d, fmt.Sprintf("downloaded file is gone after a restart: %s", err))
+				continue
+			}
+		}
+
+		log.Infof(" > Resuming deal %s (%s) from %s", d.ProposalID, d.PieceCid, d.State)
+		resume = append(resume, proposal)
+	}
+	cl.DealsMutex.Unlock()
+
+	for _, proposal := range resume {
+		go cl.processDeal(ctx, proposal, false)
+	}
+
+	// Look for downloads we don't know about, e.g. from before the state was kept
+	untracked := make(map[string]bool)
+	inRoot := make(map[string]string) // untracked files directly in a download root, by name
+	for _, root := range cl.Configuration.Roots() {
+		for _, dir := range []string{root.Path, filepath.Join(root.Path, stagingDir)} {
+			entries, err := os.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() && !tracked[entry.Name()] {
+					untracked[entry.Name()] = true
+					if dir == root.Path {
+						inRoot[entry.Name()] = filepath.Join(dir, entry.Name())
+					}
+				}
+			}
+		}
+	}
+
+	if len(untracked) > 0 {
+		log.Infof(" > %d untracked files in the download roots, matching them against %d pending proposals", len(untracked), len(proposals))
+	}
+	for _, proposal := range proposals {
+		if len(untracked) == 0 {
+			break
+		}
+
+		manifest, err := cl.SpadeClient.RequestPieceManifest(ctx, proposal.ProposalID)
+		if err != nil {
+			log.Warnf("  > Could not fetch manifest for %s: %s", proposal.ProposalID, err)
+			continue
+		}
+
+		name := fmt.Sprintf("%s", manifest.FRC58CommP.PCidV2())
+		if !untracked[name] {
+			continue
+		}
+		delete(untracked, name)
+
+		// Only the files we moved into place ourselves are known to be complete
+		if filename, ok := inRoot[name]; ok {
+			err = stageDownload(filename)
+			if err != nil {
+				log.Warnf("  > Could not stage the earlier download %s, not resuming deal %s: %s", filename, proposal.ProposalID, err)
+				continue
+			}
+		}
+
+		log.Infof("  > Found an earlier download of %s for deal %s, resuming", name, proposal.ProposalID)
+		go cl.HandleDeal(ctx, proposal)
+	}
+
+	log.Infof(" > Resumed %d deals", len(resume))
+	return nil
+}
+
+// abandonActiveDeals marks all deals that were active before a restart as failed, so they are handled again
+// from scratch when their proposal is seen
+func (cl *Client) abandonActiveDeals(reason string) {
+	cl.DealsMutex.Lock()
+	defer cl.DealsMutex.Unlock()
+
+	for _, d := range cl.Deals {
+		if d.IsActive() {
+			cl.abandonDeal(d, reason)
+		}
+	}
+}
+
+func (cl *Client) abandonDeal(d *deal.Deal, reason string) {
+	err := cl.updateDeal(d, func(d *deal.Deal) error {
+		return d.Transition(deal.Failed, reason)
+	})
+	if err != nil {
+		log.Warnf("Could not abandon deal %s: %s", d.PieceCid, err)
+	}
+}
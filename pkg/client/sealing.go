@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"filecoin-spade-client/pkg/log"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Short names for the sealing states, as they are commonly referred to
+var sealingStateAliases = map[string]string{
+	"PC1": "PreCommit1",
+	"PC2": "PreCommit2",
+	"C1":  "Committing",
+	"C2":  "Committing",
+}
+
+// sealingCapacity returns how many pieces can still be added to the sealing pipeline before one of the configured
+// per-state limits is reached, or -1 when there are no limits configured
+func (cl *Client) sealingCapacity(ctx context.Context) (int, error) {
+	if len(cl.Configuration.SealingLimits) == 0 {
+		return -1, nil
+	}
+
+	pipeline, err := cl.BoostClient.GetBoostSealingPipeline(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	sectors := make(map[string]int)
+	for _, states := range pipeline.Data.SealingPipeline.SectorStates {
+		for _, sectorState := range states {
+			sectors[strings.ToLower(sectorState.Key)] += sectorState.Value
+		}
+	}
+
+	capacity := -1
+	var names []string
+	for name := range cl.Configuration.SealingLimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var usage []string
+	for _, name := range names {
+		limit := cl.Configuration.SealingLimits[name]
+		key := name
+		if alias, ok := sealingStateAliases[strings.ToUpper(name)]; ok {
+			key = alias
+		}
+
+		count := sectors[strings.ToLower(key)]
+		usage = append(usage, fmt.Sprintf("%s=%d/%d", name, count, limit))
+
+		left := limit - count
+		if left < 0 {
+			left = 0
+		}
+		if capacity == -1 || left < capacity {
+			capacity = left
+		}
+	}
+
+	log.Infof("Sealing pipeline: %s", strings.Join(usage, ", "))
+	return capacity, nil
+}
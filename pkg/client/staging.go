@@ -0,0 +1,63 @@
+package client
+
+import (
+	"golang.org/x/xerrors"
+	"os"
+	"path/filepath"
+)
+
+// Downloads are written to the staging directory of their download root, and only moved to the download root
+// once they are complete and verified. A file directly in a download root is always complete.
+const stagingDir = "staging"
+
+// stagingFilename returns where the download of a file is written to until it is complete
+func stagingFilename(filename string) string {
+	return filepath.Join(filepath.Dir(filename), stagingDir, filepath.Base(filename))
+}
+
+// finalFilename returns where a file in the staging directory ends up once it is complete
+func finalFilename(filename string) string {
+	if filepath.Base(filepath.Dir(filename)) != stagingDir {
+		return filename
+	}
+	return filepath.Join(downloadRoot(filename), filepath.Base(filename))
+}
+
+// downloadRoot returns the download root of a file, which is either directly in it or in its staging directory
+func downloadRoot(filename string) string {
+	dir := filepath.Dir(filename)
+	if filepath.Base(dir) == stagingDir {
+		return filepath.Dir(dir)
+	}
+	return dir
+}
+
+// promoteDownload moves a complete download from the staging directory into the download root. The staging
+// directory is on the same filesystem, so the file appears in the download root at once.
+func promoteDownload(filename string) error {
+	err := os.Rename(stagingFilename(filename), filename)
+	if err != nil {
+		return xerrors.Errorf("could not move the download into place: %w", err)
+	}
+	return nil
+}
+
+// stageDownload moves a file in a download root that we didn't move there ourselves into the staging directory.
+// It may be an incomplete assembly, e.g. from before downloads were staged; from the staging directory its
+// download is resumed and verified like any other. When there already is a staged download of the file, that one
+// is kept.
+func stageDownload(filename string) error {
+	staged := stagingFilename(filename)
+	if _, err := os.Stat(staged); err == nil {
+		return os.Remove(filename)
+	}
+	err := os.MkdirAll(filepath.Dir(staged), 0o755)
+	if err != nil {
+		return xerrors.Errorf("could not create the staging directory: %w", err)
+	}
+	err = os.Rename(filename, staged)
+	if err != nil {
+		return xerrors.Errorf("could not move the download to the staging directory: %w", err)
+	}
+	return nil
+}
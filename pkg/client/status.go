@@ -0,0 +1,149 @@
+package client
+
+import (
+	"encoding/json"
+	"filecoin-spade-client/pkg/deal"
+	"filecoin-spade-client/pkg/schedule"
+	"filecoin-spade-client/pkg/sources"
+	"filecoin-spade-client/pkg/state"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	statusBucket = "status"
+	statusKey    = "current"
+)
+
+// Status is a snapshot of what the client is doing, written to the state store on every scan so it can be
+// inspected with the status command while the client runs
+type Status struct {
+	UpdatedAt     time.Time `json:"updated_at"`
+	Budget        Budget    `json:"budget"`
+	Blackout      string    `json:"blackout,omitempty"` // active reservation blackout window
+	Bandwidth     uint64    `json:"bandwidth"`          // shared download limit in bytes per second, 0 is unlimited
+	PieceCache    uint64    `json:"piece_cache"`        // bytes in the piece cache
+	MaxPieceCache uint64    `json:"max_piece_cache"`    // 0 when the piece cache is disabled
+	QueueLength   int       `json:"queue_length"`
+	QueueCapacity int       `json:"queue_capacity"`
+	Downloads     int       `json:"downloads"`
+	MaxDownloads  int       `json:"max_downloads"`
+	Imports       int       `json:"imports"`
+	MaxImports    int       `json:"max_imports"`
+
+	Progress []DownloadProgress           `json:"progress,omitempty"`
+	Sources  map[string]sources.HostStats `json:"sources,omitempty"`
+}
+
+func (cl *Client) writeStatus() {
+	cl.Bandwidth.Refresh()
+	status := Status{
+		UpdatedAt:     time.Now(),
+		Budget:        cl.budget(),
+		Bandwidth:     cl.Bandwidth.Current(),
+		QueueLength:   cl.Queue.Len(),
+		QueueCapacity: cl.Queue.Capacity(),
+		Downloads:     len(cl.downloadSlots),
+		MaxDownloads:  cap(cl.downloadSlots),
+		Imports:       len(cl.importSlots),
+		MaxImports:    cap(cl.importSlots),
+		Progress:      cl.DownloadProgress(),
+		Sources:       cl.Sources.Stats(),
+	}
+	if cl.PieceCache != nil {
+		status.PieceCache = cl.PieceCache.Size()
+		status.MaxPieceCache = cl.Configuration.PieceCacheSize
+	}
+	if window, active := schedule.Active(cl.Configuration.ReservationBlackouts, status.UpdatedAt); active {
+		status.Blackout = window.String()
+	}
+	cl.persist(statusBucket, statusKey, status)
+}
+
+// PrintStatus writes a human readable overview of the state store to w
+func PrintStatus(w io.Writer, store *state.Store) error {
+	var status Status
+	var deals []*deal.Deal
+	err := store.View(func(tx *state.Tx) error {
+		if _, err := tx.Get(statusBucket, statusKey, &status); err != nil {
+			return err
+		}
+		return tx.ForEach(dealsBucket, func(key string, value json.RawMessage) error {
+			d := new(deal.Deal)
+			if err := json.Unmarshal(value, d); err != nil {
+				return err
+			}
+			deals = append(deals, d)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if status.UpdatedAt.IsZero() {
+		fmt.Fprintf(w, "No status written yet\n")
+	} else {
+		fmt.Fprintf(w, "Status of %s (%s ago)\n", status.UpdatedAt.Format(time.RFC3339), time.Since(status.UpdatedAt).Round(time.Second))
+		fmt.Fprintf(w, "  Onboarding budget: %s\n", status.Budget)
+		if status.Blackout != "" {
+			fmt.Fprintf(w, "  Reservations:      paused by blackout %q\n", status.Blackout)
+		}
+		fmt.Fprintf(w, "  Queue:             %d of %d\n", status.QueueLength, status.QueueCapacity)
+		fmt.Fprintf(w, "  Downloads:         %d of %d\n", status.Downloads, status.MaxDownloads)
+		fmt.Fprintf(w, "  Imports:           %d of %d\n", status.Imports, status.MaxImports)
+		if status.Bandwidth > 0 {
+			fmt.Fprintf(w, "  Bandwidth limit:   %s/s\n", humanize.IBytes(status.Bandwidth))
+		} else {
+			fmt.Fprintf(w, "  Bandwidth limit:   unlimited\n")
+		}
+		if status.MaxPieceCache > 0 {
+			fmt.Fprintf(w, "  Piece cache:       %s of %s\n", humanize.IBytes(status.PieceCache), humanize.IBytes(status.MaxPieceCache))
+		}
+		if len(status.Progress) > 0 {
+			fmt.Fprintf(w, "\nDownloading:\n")
+			for _, p := range status.Progress {
+				fmt.Fprintf(w, "  %s %s\n", p.PieceCid, p)
+			}
+		}
+		if len(status.Sources) > 0 {
+			hosts := make([]string, 0, len(status.Sources))
+			for host := range status.Sources {
+				hosts = append(hosts, host)
+			}
+			sort.Slice(hosts, func(i, j int) bool { return status.Sources[hosts[i]].Score() > status.Sources[hosts[j]].Score() })
+			fmt.Fprintf(w, "\nSources:\n")
+			for _, host := range hosts {
+				fmt.Fprintf(w, "  %-40s %s\n", host, status.Sources[host])
+			}
+		}
+	}
+
+	counts := make(map[deal.State]int)
+	for _, d := range deals {
+		counts[d.State]++
+	}
+	fmt.Fprintf(w, "\nDeals:\n")
+	for _, s := range []deal.State{deal.Reserved, deal.ProposalSeen, deal.ManifestFetched, deal.Downloading, deal.Downloaded, deal.Importing, deal.Imported, deal.Failed, deal.Cancelled} {
+		fmt.Fprintf(w, "  %-16s %d\n", s, counts[s])
+	}
+
+	sort.Slice(deals, func(i, j int) bool { return deals[i].UpdatedAt.After(deals[j].UpdatedAt) })
+	fmt.Fprintf(w, "\nIn progress:\n")
+	for _, d := range deals {
+		if d.State == deal.Reserved || d.IsActive() {
+			fmt.Fprintf(w, "  %s %-16s %8s since %s", d.PieceCid, d.State, humanize.IBytes(d.PieceSize), d.UpdatedAt.Format(time.RFC3339))
+			if d.ProposalID != "" {
+				fmt.Fprintf(w, " proposal %s", d.ProposalID)
+			}
+			if d.Reason != "" {
+				fmt.Fprintf(w, " (%s)", d.Reason)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"filecoin-spade-client/pkg/config"
+	"filecoin-spade-client/pkg/downloader"
+	"filecoin-spade-client/pkg/spadeclient"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadTransport(t *testing.T) {
+	data := bytes.Repeat([]byte("spade"), 200<<10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "piece", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	host := u.Hostname()
+
+	newClient := func(t *testing.T) *Client {
+		cfg := config.NewDefaultConfiguration()
+		cfg.StatePath = t.TempDir()
+		cfg.DownloadPath = t.TempDir()
+		cfg.DownloadConfig.Backend = downloader.BackendHttp
+		return New(cfg)
+	}
+	defer resetTransport()
+
+	tests := []struct {
+		name    string
+		fetch   func(t *testing.T, cl *Client, ctx context.Context)
+		tracked bool
+	}{
+		{
+			name: "http backend",
+			fetch: func(t *testing.T, cl *Client, ctx context.Context) {
+				job := downloader.Job{ProposalID: "proposal", Sources: []string{server.URL}, Filename: filepath.Join(t.TempDir(), "piece")}
+				if err := cl.Downloaders[downloader.BackendHttp].Download(ctx, job); err != nil {
+					t.Fatal(err)
+				}
+			},
+			tracked: true,
+		},
+		{
+			// Like the assembler does
+			name: "default client",
+			fetch: func(t *testing.T, cl *Client, ctx context.Context) {
+				cl.installTransport()
+				get(t, ctx, server.URL)
+			},
+			tracked: true,
+		},
+		{
+			name: "default client without a download context",
+			fetch: func(t *testing.T, cl *Client, ctx context.Context) {
+				cl.installTransport()
+				get(t, context.Background(), server.URL)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer resetTransport()
+			cl := newClient(t)
+			proposal := spadeclient.DealProposal{ProposalID: "proposal", PieceCid: "piece", PieceSize: 2 << 20}
+			ctx, stop := cl.downloadContext(context.Background(), proposal, 1)
+			test.fetch(t, cl, ctx)
+			tracked := cl.trackedBytes(proposal.PieceCid)
+			stop()
+
+			expected := uint64(0)
+			if test.tracked {
+				expected = uint64(len(data))
+			}
+			if tracked != expected {
+				t.Errorf("progress tracked %d bytes, expected %d", tracked, expected)
+			}
+			if bytes := cl.Sources.Stats()[host].Bytes; bytes != expected {
+				t.Errorf("host statistics have %d bytes, expected %d", bytes, expected)
+			}
+		})
+	}
+}
+
+func TestInstallTransportOnce(t *testing.T) {
+	defer resetTransport()
+
+	first := New(config.NewDefaultConfiguration())
+	second := New(config.NewDefaultConfiguration())
+	first.installTransport()
+	first.installTransport()
+	second.installTransport()
+
+	if http.DefaultTransport != first.transport {
+		t.Fatal("the default transport is not the transport of the first client")
+	}
+	if next := first.transport.(*progressTransport).next; next == http.DefaultTransport {
+		t.Fatal("the transport wraps itself")
+	}
+}
+
+func get(t *testing.T, ctx context.Context, url string) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func resetTransport() {
+	http.DefaultTransport = baseTransport
+	installTransport = sync.Once{}
+}
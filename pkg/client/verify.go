@@ -0,0 +1,114 @@
+package client
+
+import (
+	"bytes"
+	"filecoin-spade-client/pkg/deal"
+	"filecoin-spade-client/pkg/log"
+	"filecoin-spade-client/pkg/spadeclient"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const quarantineDir = "quarantine"
+
+// The reason of deals whose download failed the verification starts with this
+const verificationFailed = "commP verification failed"
+
+// verifyPiece computes the piece commitment of a downloaded file and compares it with the commitment in the
+// manifest and the piece CID and size of the proposal. A mismatch is returned as an error.
+func verifyPiece(filename string, manifestCommP cid.Cid, proposal spadeclient.DealProposal) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	calc := new(commp.Calc)
+	_, err = io.CopyBuffer(calc, file, make([]byte, 4<<20))
+	if err != nil {
+		calc.Reset()
+		return xerrors.Errorf("could not read %s: %w", filename, err)
+	}
+	rawCommP, paddedSize, err := calc.Digest()
+	if err != nil {
+		return xerrors.Errorf("could not compute commP: %w", err)
+	}
+
+	pieceSize := uint64(proposal.PieceSize)
+	if paddedSize > pieceSize {
+		return xerrors.Errorf("file needs a piece of %s, the proposal is for %s", humanize.IBytes(paddedSize), humanize.IBytes(pieceSize))
+	}
+
+	// The manifest's commitment (a v2 piece CID) ends with the tree height and the root
+	digest := manifestCommP.Hash()
+	if len(digest) < 33 {
+		return xerrors.Errorf("unexpected commP %s in the manifest", manifestCommP)
+	}
+	manifestSize := uint64(32) << digest[len(digest)-33]
+	if manifestSize < paddedSize {
+		return xerrors.Errorf("file needs a piece of %s, the manifest is for %s", humanize.IBytes(paddedSize), humanize.IBytes(manifestSize))
+	}
+	manifestRoot, err := commp.PadCommP(rawCommP, paddedSize, manifestSize)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(manifestRoot, digest[len(digest)-32:]) {
+		return xerrors.Errorf("commP does not match %s from the manifest", manifestCommP)
+	}
+
+	proposalRoot, err := commp.PadCommP(rawCommP, paddedSize, pieceSize)
+	if err != nil {
+		return err
+	}
+	pieceCid, err := commcid.DataCommitmentV1ToCID(proposalRoot)
+	if err != nil {
+		return err
+	}
+	if pieceCid.String() != proposal.PieceCid {
+		return xerrors.Errorf("piece CID %s does not match %s from the proposal", pieceCid, proposal.PieceCid)
+	}
+	return nil
+}
+
+// verifyDownload checks the downloaded file of a deal before it is imported. When it doesn't match, the file is
+// moved out of the way into the quarantine directory and the deal is marked as failed. The same proposal isn't
+// downloaded over and over again, a new proposal for the piece is handled as usual.
+func (cl *Client) verifyDownload(proposal spadeclient.DealProposal, filename string, manifestCommP cid.Cid) bool {
+	log.Infof("Verifying the piece commitment of %s (%s)", proposal.ProposalID, filename)
+	started := time.Now()
+	err := verifyPiece(filename, manifestCommP, proposal)
+	if err == nil {
+		log.Infof(" > Piece commitment of %s verified in %s", proposal.ProposalID, time.Since(started).Round(time.Second))
+		return true
+	}
+
+	log.Errorf(" > Downloaded file for %s is corrupt: %s", proposal.ProposalID, err)
+	// Named after the proposal and the time, so earlier quarantined files of the piece are kept
+	quarantined := filepath.Join(downloadRoot(filename), quarantineDir, fmt.Sprintf("%s.%s.%d", filepath.Base(filename), proposal.ProposalID, time.Now().Unix()))
+	moveErr := os.MkdirAll(filepath.Dir(quarantined), 0o755)
+	if moveErr == nil {
+		moveErr = os.Rename(filename, quarantined)
+	}
+	if moveErr != nil {
+		log.Warnf(" > Could not quarantine %s: %s", filename, moveErr)
+		cl.failDeal(proposal, fmt.Sprintf("%s: %s", verificationFailed, err))
+		return false
+	}
+	log.Warnf(" > Moved %s to %s", filename, quarantined)
+	cl.failDeal(proposal, fmt.Sprintf("%s, file quarantined in %s: %s", verificationFailed, quarantined, err))
+	return false
+}
+
+// failedVerification returns whether the download of the deal failed the verification
+func failedVerification(d *deal.Deal) bool {
+	return d.State == deal.Failed && strings.HasPrefix(d.Reason, verificationFailed)
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"filecoin-spade-client/pkg/spadeclient"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Multihash of v2 piece CIDs (FRC-0069)
+const fr32Sha256Trunc254Padbintree = 0x1011
+
+func TestVerifyPiece(t *testing.T) {
+	data := make([]byte, 1000) // fr32 padded to 1016 bytes, in a piece of 1 KiB
+	rand.New(rand.NewSource(1)).Read(data)
+	other := bytes.Clone(data)
+	other[0]++
+
+	tests := []struct {
+		name         string
+		data         []byte
+		manifestData []byte // what the manifest's commP was computed from
+		manifestSize uint64
+		pieceData    []byte // what the proposal's piece CID was computed from
+		pieceSize    uint64 // what the proposal's piece CID was padded to
+		proposalSize uint64 // the piece size of the proposal, when it differs from pieceSize
+		err          string
+	}{
+		{name: "exact piece size", data: data, manifestData: data, manifestSize: 1024, pieceData: data, pieceSize: 1024},
+		{name: "proposal for a larger piece", data: data, manifestData: data, manifestSize: 1024, pieceData: data, pieceSize: 4096},
+		{name: "manifest for a larger piece", data: data, manifestData: data, manifestSize: 2048, pieceData: data, pieceSize: 4096},
+		{name: "corrupt file", data: other, manifestData: data, manifestSize: 1024, pieceData: data, pieceSize: 1024, err: "from the manifest"},
+		{name: "manifest for another piece", data: data, manifestData: other, manifestSize: 1024, pieceData: data, pieceSize: 1024, err: "from the manifest"},
+		{name: "proposal for another piece", data: data, manifestData: data, manifestSize: 1024, pieceData: other, pieceSize: 1024, err: "from the proposal"},
+		{name: "proposal padded differently", data: data, manifestData: data, manifestSize: 1024, pieceData: data, pieceSize: 2048, proposalSize: 1024, err: "from the proposal"},
+		{name: "proposal too small", data: data, manifestData: data, manifestSize: 1024, pieceData: data, pieceSize: 512, err: "the proposal is for"},
+		{name: "manifest too small", data: data, manifestData: data, manifestSize: 512, pieceData: data, pieceSize: 1024, err: "the manifest is for"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "piece")
+			if err := os.WriteFile(filename, test.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			proposal := spadeclient.DealProposal{
+				ProposalID: "proposal",
+				PieceSize:  int64(test.pieceSize),
+				PieceCid:   pieceCidV1(t, test.pieceData, test.pieceSize).String(),
+			}
+			if test.proposalSize != 0 {
+				proposal.PieceSize = int64(test.proposalSize)
+			}
+
+			err := verifyPiece(filename, pieceCidV2(t, test.manifestData, test.manifestSize), proposal)
+			switch {
+			case test.err == "" && err != nil:
+				t.Fatalf("unexpected error: %s", err)
+			case test.err != "" && err == nil:
+				t.Fatalf("expected an error containing %q", test.err)
+			case test.err != "" && !strings.Contains(err.Error(), test.err):
+				t.Fatalf("error %q, expected one containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+// commitment returns the root of the data, padded to a piece of the given size
+func commitment(t *testing.T, data []byte, size uint64) []byte {
+	t.Helper()
+	calc := new(commp.Calc)
+	if _, err := calc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	root, paddedSize, err := calc.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size < paddedSize {
+		// Too small for the data, any root will do
+		return root
+	}
+	root, err = commp.PadCommP(root, paddedSize, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func pieceCidV1(t *testing.T, data []byte, size uint64) cid.Cid {
+	t.Helper()
+	c, err := commcid.DataCommitmentV1ToCID(commitment(t, data, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// pieceCidV2 builds a v2 piece CID, whose digest is the padding as a varint, the height of the tree and the root
+func pieceCidV2(t *testing.T, data []byte, size uint64) cid.Cid {
+	t.Helper()
+	height := bits.TrailingZeros64(size / 32)
+	padding := size/128*127 - uint64(len(data))
+	if uint64(len(data)) > size/128*127 {
+		padding = 0
+	}
+	digest := binary.AppendUvarint(nil, padding)
+	digest = append(digest, byte(height))
+	digest = append(digest, commitment(t, data, size)...)
+	mh, err := multihash.Encode(digest, fr32Sha256Trunc254Padbintree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(cid.Raw, mh)
+}
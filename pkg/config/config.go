@@ -2,27 +2,233 @@ package config
 
 import (
 	"filecoin-spade-client/pkg/log"
+	"filecoin-spade-client/pkg/schedule"
 	"fmt"
+	"github.com/dustin/go-humanize"
 	cliutil "github.com/filecoin-project/lotus/cli/util"
 	"github.com/mcuadros/go-defaults"
+	"golang.org/x/xerrors"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const (
+	PlaceByFreeSpace = "free-space"
+	PlaceRoundRobin  = "round-robin"
+)
+
 type Configuration struct {
-	DownloadPath        string `default:"/tmp/filecoin-spade-downloads"`
-	MaxSpadeDealsActive int    `default:"20"`
-	InsecureSkipVerify  bool   `default:"false"`
+	DownloadPath       string `default:"/tmp/filecoin-spade-downloads"`
+	StatePath          string `default:""`
+	MaxReservations    int    `default:"2"` // reserved pieces waiting for their proposal
+	MaxDownloads       int    `default:"2"`
+	MaxImports         int    `default:"1"`
+	QueueSize          int    `default:"100"` // matched proposals waiting for a download slot
+	InsecureSkipVerify bool   `default:"false"`
+	VerifyDownloads    bool   `default:"true"` // compare the commP of downloaded files with the proposal before import
+
+	// Reservations without a pending proposal are given up after this, in case we missed their failure
+	ReservationTTL time.Duration `default:"24h"` // 0 keeps them until they fail
+
+	ProgressInterval time.Duration `default:"1m"` // how often the progress of downloads is logged, 0 disables it
+
+	// Removal of files in the download path that are no longer needed. Files of failed deals and quarantined files
+	// are kept for the grace period.
+	GCInterval    time.Duration `default:"1h"` // 0 disables it
+	GCGracePeriod time.Duration `default:"24h"`
+	GCDryRun      bool          `default:"false"`
+	// Imported, cancelled and failed deals are forgotten this long after their last change, once their files are
+	// gone. 0 keeps them.
+	DealRetention time.Duration `default:"168h"`
+
+	// Directories the downloads are spread over, when there are none DownloadPath is the only one. Deals are placed
+	// in the root with the most available space, or in turns.
+	DownloadRoots     []DownloadRoot
+	DownloadPlacement string `default:"free-space"`
+
+	// Bytes to keep free in each download root, on top of the space claimed by reserved and downloading pieces
+	DownloadSpaceReserve uint64 `default:"10737418240"`
 
-	LotusConfig LotusConfig
-	SpadeConfig SpadeConfig
-	BoostConfig BoostConfig
+	// Directory of verified pieces that are reused when a piece is proposed again, empty disables it. Best on the
+	// same filesystem as the download roots, so pieces are hardlinked instead of copied.
+	PieceCachePath string `default:""`
+	PieceCacheSize uint64 `default:"1099511627776"` // least recently used pieces are evicted beyond this
+
+	// Bytes (padded) we reserve at most per rolling day and week, 0 is unlimited
+	DailyBudget  uint64 `default:"0"`
+	WeeklyBudget uint64 `default:"0"`
+
+	// Windows (e.g. maintenance or peak tariff hours) in which no new pieces are reserved, deals that are
+	// already reserved are still downloaded and imported
+	ReservationBlackouts []schedule.Window
+
+	// Estimate of how long it takes to seal a sector once the deal is imported, used to skip proposals that
+	// can not be finished before their start
+	SealingDuration time.Duration `default:"8h"`
+
+	// Maximum amount of sectors per sealing state (as named by Boost, e.g. AddPiece, PreCommit1, WaitSeed)
+	// before we stop reserving new deals
+	SealingLimits map[string]int
+
+	LotusConfig    LotusConfig
+	SpadeConfig    SpadeConfig
+	BoostConfig    BoostConfig
+	DownloadConfig DownloadConfig
 }
 
 type SpadeConfig struct {
 	Url                    string        `default:"https://api.spade.storacha.network"`
 	PendingRefreshInterval time.Duration `default:"30s"`
+
+	// Pieces we requested are not requested again until this long after, 0 never requests them again
+	RequestedPieceTTL time.Duration `default:"72h"`
+
+	PieceSelection string        `default:"first-fit"` // see spadeclient.PieceSelectors
+	TenantWeights  map[int16]int // for the tenant-round-robin piece selection, tenants default to 1
+
+	// Padded piece sizes we reserve, a maximum of 0 means up to the sector size of the miner
+	MinPieceSize uint64 `default:"0"`
+	MaxPieceSize uint64 `default:"0"`
+
+	AllowedTenants []int16 // when set, only pieces claimed by one of these tenants are reserved
+	DeniedTenants  []int16
+	TenantQuotas   map[int16]TenantQuota
+
+	// Check whether a sample of the sources of a piece responds before reserving it, pieces without a reachable
+	// source are skipped. The result is remembered for the cache duration.
+	ProbeSources       bool          `default:"false"`
+	ProbeSamples       int           `default:"3"`
+	ProbeTimeout       time.Duration `default:"5s"`
+	ProbeCacheDuration time.Duration `default:"30m"`
+	ProbeBudget        time.Duration `default:"30s"` // time spent probing per request for a new deal
+}
+
+// TenantQuota limits how many bytes (padded) we reserve for a tenant in a rolling day and week, 0 is unlimited
+type TenantQuota struct {
+	DailyBytes  uint64
+	WeeklyBytes uint64
+}
+
+// DownloadRoot is a directory downloads are placed in. Capacity limits how many bytes of downloads it holds, 0 is
+// up to the free space.
+type DownloadRoot struct {
+	Path     string
+	Capacity uint64
+}
+
+// Roots returns the configured download roots, or DownloadPath when there are none
+func (c Configuration) Roots() []DownloadRoot {
+	if len(c.DownloadRoots) > 0 {
+		return c.DownloadRoots
+	}
+	return []DownloadRoot{{Path: filepath.Clean(c.DownloadPath)}}
+}
+
+// DownloadConfig tunes how the segments of a piece are downloaded and assembled
+type DownloadConfig struct {
+	Parallelism int           `default:"50"`  // segments downloaded at the same time, per deal
+	Timeout     time.Duration `default:"10m"` // per segment
+	Retries     int           `default:"5"`   // per segment
+
+	TenantOverrides map[int16]DownloadOverride
+
+	// Backend that downloads the pieces (see downloader.Backends), unless one is configured for the tenant or the
+	// host of one of the sources of the piece
+	Backend        string `default:"assembler"`
+	TenantBackends map[int16]string
+	HostBackends   map[string]string
+
+	PieceUrl       string // template of the URL of whole pieces for the http and aria2 backends, instead of the sources
+	LocalPiecePath string // template of the path of whole pieces for the local backend
+	Aria2Url       string `default:"ws://127.0.0.1:6800/jsonrpc"`
+	Aria2Secret    string
+
+	// Bytes per second shared by all downloads and per download, 0 is unlimited. The first schedule rule with an
+	// active window replaces the shared limit.
+	BandwidthLimit     uint64 `default:"0"`
+	DealBandwidthLimit uint64 `default:"0"`
+	BandwidthSchedule  []BandwidthRule
+
+	// Hosts pieces and segments are downloaded from: only the allowed ones when there are any, never the denied
+	// ones. Entries are host names, or *.domain for all hosts in a domain.
+	SourceAllow []string
+	SourceDeny  []string
+	// Replace the first matching prefix of source URLs, e.g. to route them through a caching proxy
+	SourceRewrites []UrlRewrite
+	// Hosts with a higher error rate are skipped until they haven't failed for the cooldown, 0 never skips
+	SourceMaxErrorRate float64       `default:"0"`
+	SourceCooldown     time.Duration `default:"5m"`
+}
+
+// UrlRewrite replaces the prefix From of a URL with To
+type UrlRewrite struct {
+	From string
+	To   string
+}
+
+// BandwidthRule is the shared download bandwidth limit during a window, 0 is unlimited
+type BandwidthRule struct {
+	Window schedule.Window
+	Limit  uint64
+}
+
+// DownloadOverride replaces the download settings for the deals of a tenant, zero values keep the default
+type DownloadOverride struct {
+	Parallelism int
+	Timeout     time.Duration
+	Retries     int
+}
+
+// ForTenant returns the download settings for the deals of a tenant
+func (c DownloadConfig) ForTenant(tenant int16) DownloadConfig {
+	override, ok := c.TenantOverrides[tenant]
+	if !ok {
+		return c
+	}
+	if override.Parallelism > 0 {
+		c.Parallelism = override.Parallelism
+	}
+	if override.Timeout > 0 {
+		c.Timeout = override.Timeout
+	}
+	if override.Retries > 0 {
+		c.Retries = override.Retries
+	}
+	return c
+}
+
+// HostAllowed returns whether downloads from the host are allowed by the allow and deny lists
+func (c DownloadConfig) HostAllowed(host string) bool {
+	if matchHost(c.SourceDeny, host) {
+		return false
+	}
+	return len(c.SourceAllow) == 0 || matchHost(c.SourceAllow, host)
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		} else if strings.EqualFold(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// RewriteUrl applies the first rewrite rule with a matching prefix to the URL
+func (c DownloadConfig) RewriteUrl(url string) string {
+	for _, rewrite := range c.SourceRewrites {
+		if rest, ok := strings.CutPrefix(url, rewrite.From); ok {
+			return rewrite.To + rest
+		}
+	}
+	return url
 }
 
 type LotusConfig struct {
@@ -38,11 +244,41 @@ type BoostConfig struct {
 	BoostAuthToken string `default:"undefined"`
 	GraphQlPort    int    `default:"8080"`
 	GraphQlUrl     string `default:""`
+
+	// Where Boost finds the files we download, when it mounts the download roots under a different path. At startup
+	// we can check that Boost can open the files in every download root, by default only when there are mappings.
+	PathMappings []PathMapping
+	CheckPaths   bool `default:"false"`
+}
+
+// PathMapping translates a local path prefix to the path Boost sees it as
+type PathMapping struct {
+	Local string
+	Boost string
+}
+
+// BoostPath returns the path Boost sees a local file as, using the mapping with the longest matching prefix
+func (c BoostConfig) BoostPath(local string) string {
+	best := -1
+	for i, mapping := range c.PathMappings {
+		if local != mapping.Local && !strings.HasPrefix(local, strings.TrimSuffix(mapping.Local, "/")+"/") {
+			continue
+		}
+		if best < 0 || len(mapping.Local) > len(c.PathMappings[best].Local) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return local
+	}
+	mapping := c.PathMappings[best]
+	return filepath.Join(mapping.Boost, strings.TrimPrefix(local, mapping.Local))
 }
 
 func NewDefaultConfiguration() Configuration {
 	config := new(Configuration)
 	defaults.SetDefaults(config)
+	config.StatePath = DefaultStatePath()
 
 	info := cliutil.ParseApiInfo(os.Getenv("FULLNODE_API_INFO"))
 	daemonUrl, err := info.DialArgs("v1")
@@ -78,3 +314,233 @@ func NewDefaultConfiguration() Configuration {
 
 	return *config
 }
+
+// DefaultStatePath is the directory the client keeps its state in, unless configured otherwise
+func DefaultStatePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".filecoin-spade-client"
+	}
+	return filepath.Join(home, ".filecoin-spade-client")
+}
+
+// ParseDownloadRoots parses a list of Path or Path=Capacity entries, e.g. /mnt/disk1=8TiB
+func ParseDownloadRoots(values []string) ([]DownloadRoot, error) {
+	var roots []DownloadRoot
+	for _, value := range values {
+		root := DownloadRoot{Path: value}
+		if i := strings.LastIndex(value, "="); i >= 0 {
+			capacity, err := humanize.ParseBytes(strings.TrimSpace(value[i+1:]))
+			if err != nil {
+				return nil, xerrors.Errorf("invalid capacity in download root %q: %+v", value, err)
+			}
+			root = DownloadRoot{Path: value[:i], Capacity: capacity}
+		}
+		root.Path = filepath.Clean(strings.TrimSpace(root.Path))
+		if root.Path == "." {
+			return nil, xerrors.Errorf("invalid download root %q, expected Path or Path=Capacity", value)
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// ParsePathMappings parses a list of LocalPath=BoostPath entries, e.g. /mnt/downloads=/srv/spade
+func ParsePathMappings(values []string) ([]PathMapping, error) {
+	var mappings []PathMapping
+	for _, value := range values {
+		local, boost, found := strings.Cut(value, "=")
+		local = strings.TrimSpace(local)
+		boost = strings.TrimSpace(boost)
+		if !found || !filepath.IsAbs(local) || !filepath.IsAbs(boost) {
+			return nil, xerrors.Errorf("invalid path mapping %q, expected LocalPath=BoostPath with absolute paths", value)
+		}
+		mappings = append(mappings, PathMapping{Local: filepath.Clean(local), Boost: filepath.Clean(boost)})
+	}
+	return mappings, nil
+}
+
+// ParseUrlRewrites parses a list of From=To URL prefix rewrites
+func ParseUrlRewrites(values []string) ([]UrlRewrite, error) {
+	var rewrites []UrlRewrite
+	for _, value := range values {
+		from, to, found := strings.Cut(value, "=")
+		from = strings.TrimSpace(from)
+		to = strings.TrimSpace(to)
+		if !found || from == "" || to == "" {
+			return nil, xerrors.Errorf("invalid URL rewrite %q, expected From=To", value)
+		}
+		rewrites = append(rewrites, UrlRewrite{From: from, To: to})
+	}
+	return rewrites, nil
+}
+
+// ParseTenantBackends parses a list of Tenant=Backend entries
+func ParseTenantBackends(values []string) (map[int16]string, error) {
+	backends := make(map[int16]string)
+	for _, value := range values {
+		tenantPart, backend, found := strings.Cut(value, "=")
+		if !found {
+			return nil, xerrors.Errorf("invalid tenant download backend %q, expected Tenant=Backend", value)
+		}
+		tenant, err := strconv.ParseInt(strings.TrimSpace(tenantPart), 10, 16)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid tenant in download backend %q: %+v", value, err)
+		}
+		backends[int16(tenant)] = strings.TrimSpace(backend)
+	}
+	return backends, nil
+}
+
+// ParseHostBackends parses a list of Host=Backend entries
+func ParseHostBackends(values []string) (map[string]string, error) {
+	backends := make(map[string]string)
+	for _, value := range values {
+		host, backend, found := strings.Cut(value, "=")
+		if !found || strings.TrimSpace(host) == "" {
+			return nil, xerrors.Errorf("invalid host download backend %q, expected Host=Backend", value)
+		}
+		backends[strings.TrimSpace(host)] = strings.TrimSpace(backend)
+	}
+	return backends, nil
+}
+
+// ParseSealingLimits parses a list of State=Amount entries
+func ParseSealingLimits(values []string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return nil, xerrors.Errorf("invalid sealing limit %q, expected State=Amount", value)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || limit < 0 {
+			return nil, xerrors.Errorf("invalid sealing limit %q, amount should be a positive number", value)
+		}
+		limits[strings.TrimSpace(parts[0])] = limit
+	}
+	return limits, nil
+}
+
+// ParseTenantWeights parses a list of Tenant=Weight entries
+func ParseTenantWeights(values []string) (map[int16]int, error) {
+	weights := make(map[int16]int)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return nil, xerrors.Errorf("invalid tenant weight %q, expected Tenant=Weight", value)
+		}
+		tenant, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 16)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid tenant in weight %q: %+v", value, err)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || weight < 1 {
+			return nil, xerrors.Errorf("invalid tenant weight %q, weight should be at least 1", value)
+		}
+		weights[int16(tenant)] = weight
+	}
+	return weights, nil
+}
+
+// ParseTenantQuotas parses a list of Tenant:daily=Size and Tenant:weekly=Size entries, e.g. 12:daily=10TiB
+func ParseTenantQuotas(values []string) (map[int16]TenantQuota, error) {
+	quotas := make(map[int16]TenantQuota)
+	for _, value := range values {
+		tenantPart, quotaPart, found := strings.Cut(value, ":")
+		period, size, hasSize := strings.Cut(quotaPart, "=")
+		if !found || !hasSize {
+			return nil, xerrors.Errorf("invalid tenant quota %q, expected Tenant:daily=Size or Tenant:weekly=Size", value)
+		}
+		tenant, err := strconv.ParseInt(strings.TrimSpace(tenantPart), 10, 16)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid tenant in quota %q: %+v", value, err)
+		}
+		bytes, err := humanize.ParseBytes(strings.TrimSpace(size))
+		if err != nil {
+			return nil, xerrors.Errorf("invalid size in quota %q: %+v", value, err)
+		}
+
+		quota := quotas[int16(tenant)]
+		switch strings.ToLower(strings.TrimSpace(period)) {
+		case "daily", "day":
+			quota.DailyBytes = bytes
+		case "weekly", "week":
+			quota.WeeklyBytes = bytes
+		default:
+			return nil, xerrors.Errorf("invalid period in quota %q, expected daily or weekly", value)
+		}
+		quotas[int16(tenant)] = quota
+	}
+	return quotas, nil
+}
+
+// ParseTenantDownloadOverrides parses a list of Tenant:Setting=Value entries, where the setting is parallelism,
+// timeout or retries, e.g. 12:parallelism=10
+func ParseTenantDownloadOverrides(values []string) (map[int16]DownloadOverride, error) {
+	overrides := make(map[int16]DownloadOverride)
+	for _, value := range values {
+		tenantPart, settingPart, found := strings.Cut(value, ":")
+		setting, settingValue, hasValue := strings.Cut(settingPart, "=")
+		if !found || !hasValue {
+			return nil, xerrors.Errorf("invalid tenant download setting %q, expected Tenant:Setting=Value", value)
+		}
+		tenant, err := strconv.ParseInt(strings.TrimSpace(tenantPart), 10, 16)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid tenant in download setting %q: %+v", value, err)
+		}
+		settingValue = strings.TrimSpace(settingValue)
+
+		override := overrides[int16(tenant)]
+		switch strings.ToLower(strings.TrimSpace(setting)) {
+		case "parallelism":
+			override.Parallelism, err = strconv.Atoi(settingValue)
+			if err == nil && override.Parallelism < 1 {
+				err = xerrors.Errorf("should be at least 1")
+			}
+		case "timeout":
+			override.Timeout, err = time.ParseDuration(settingValue)
+			if err == nil && override.Timeout < time.Second {
+				err = xerrors.Errorf("should be at least 1s")
+			}
+		case "retries":
+			override.Retries, err = strconv.Atoi(settingValue)
+			if err == nil && override.Retries < 1 {
+				err = xerrors.Errorf("should be at least 1")
+			}
+		default:
+			return nil, xerrors.Errorf("invalid setting in %q, expected parallelism, timeout or retries", value)
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("invalid value in download setting %q: %s", value, err)
+		}
+		overrides[int16(tenant)] = override
+	}
+	return overrides, nil
+}
+
+// ParseBandwidthSchedule parses a list of Window=Rate entries, e.g. "Mon-Fri 08:00-18:00=50MiB"
+func ParseBandwidthSchedule(values []string) ([]BandwidthRule, error) {
+	var rules []BandwidthRule
+	for _, value := range values {
+		windowPart, ratePart, found := strings.Cut(value, "=")
+		if !found {
+			return nil, xerrors.Errorf("invalid bandwidth schedule %q, expected Window=Rate", value)
+		}
+		window, err := schedule.ParseWindow(strings.TrimSpace(windowPart))
+		if err != nil {
+			return nil, err
+		}
+		limit, err := ParseBandwidth(ratePart)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid rate in bandwidth schedule %q: %+v", value, err)
+		}
+		rules = append(rules, BandwidthRule{Window: window, Limit: limit})
+	}
+	return rules, nil
+}
+
+// ParseBandwidth parses a rate in bytes per second, with an optional /s suffix, e.g. 100MiB/s
+func ParseBandwidth(value string) (uint64, error) {
+	return humanize.ParseBytes(strings.TrimSuffix(strings.TrimSpace(value), "/s"))
+}
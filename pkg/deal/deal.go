@@ -0,0 +1,109 @@
+package deal
+
+import (
+	"filecoin-spade-client/pkg/spadeclient"
+	"golang.org/x/xerrors"
+	"time"
+)
+
+type State string
+
+const (
+	Reserved        State = "Reserved"        // piece reserved in Spade, waiting for the proposal to show up
+	ProposalSeen    State = "ProposalSeen"    // proposal is pending in Spade and accepted by Boost
+	ManifestFetched State = "ManifestFetched" // piece manifest is known, download can start
+	Downloading     State = "Downloading"
+	Downloaded      State = "Downloaded"
+	Importing       State = "Importing"
+	Imported        State = "Imported"
+	Failed          State = "Failed"
+	Cancelled       State = "Cancelled"
+)
+
+// transitions lists the states that can be reached from each state. Failed deals can be picked up
+// again while their proposal is still pending, Imported and Cancelled are final.
+var transitions = map[State][]State{
+	Reserved:        {ProposalSeen, Failed, Cancelled},
+	ProposalSeen:    {ManifestFetched, Failed, Cancelled},
+	ManifestFetched: {Downloading, Failed, Cancelled},
+	Downloading:     {Downloaded, Failed, Cancelled},
+	Downloaded:      {Importing, Failed, Cancelled},
+	Importing:       {Imported, Failed, Cancelled},
+	Imported:        {},
+	Failed:          {ProposalSeen, Cancelled},
+	Cancelled:       {},
+}
+
+type Transition struct {
+	From   State     `json:"from"`
+	To     State     `json:"to"`
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Deal follows a single piece from its reservation in Spade up to the import in Boost
+type Deal struct {
+	PieceCid   string                    `json:"piece_cid"`
+	ProposalID string                    `json:"proposal_id,omitempty"`
+	Proposal   *spadeclient.DealProposal `json:"proposal,omitempty"`
+	PieceSize  uint64                    `json:"piece_size"`        // padded
+	Sources    []string                  `json:"sources,omitempty"` // where Spade says the piece can be fetched
+	Root       string                    `json:"root,omitempty"`    // download root the deal is placed in
+	Filename   string                    `json:"filename,omitempty"`
+	State      State                     `json:"state"`
+	Reason     string                    `json:"reason,omitempty"`
+	CreatedAt  time.Time                 `json:"created_at"`
+	UpdatedAt  time.Time                 `json:"updated_at"`
+	History    []Transition              `json:"history"`
+}
+
+func New(pieceCid string, pieceSize uint64) *Deal {
+	d := new(Deal)
+	d.PieceCid = pieceCid
+	d.PieceSize = pieceSize
+	d.State = Reserved
+	d.CreatedAt = time.Now()
+	d.UpdatedAt = d.CreatedAt
+	return d
+}
+
+func (d *Deal) CanTransition(to State) bool {
+	for _, allowed := range transitions[d.State] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves the deal to a new state, recording when and why
+func (d *Deal) Transition(to State, reason string) error {
+	if !d.CanTransition(to) {
+		return xerrors.Errorf("deal %s cannot move from %s to %s", d.PieceCid, d.State, to)
+	}
+
+	now := time.Now()
+	d.History = append(d.History, Transition{
+		From:   d.State,
+		To:     to,
+		At:     now,
+		Reason: reason,
+	})
+	d.State = to
+	d.Reason = reason
+	d.UpdatedAt = now
+	return nil
+}
+
+// IsActive returns true when the deal is being worked on (between seeing the proposal and finishing the import)
+func (d *Deal) IsActive() bool {
+	switch d.State {
+	case ProposalSeen, ManifestFetched, Downloading, Downloaded, Importing:
+		return true
+	}
+	return false
+}
+
+func (d *Deal) IsFinal() bool {
+	return len(transitions[d.State]) == 0
+}
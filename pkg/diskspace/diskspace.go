@@ -0,0 +1,18 @@
+//go:build unix
+
+package diskspace
+
+import (
+	"golang.org/x/xerrors"
+	"syscall"
+)
+
+// Free returns the amount of bytes available to unprivileged users on the filesystem holding path
+func Free(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, xerrors.Errorf("could not check free space of %s: %+v", path, err)
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
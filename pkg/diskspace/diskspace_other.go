@@ -0,0 +1,12 @@
+//go:build !unix
+
+package diskspace
+
+import (
+	"golang.org/x/xerrors"
+)
+
+// Free is not supported on this platform
+func Free(path string) (uint64, error) {
+	return 0, xerrors.New("checking free disk space is not supported on this platform")
+}
@@ -0,0 +1,49 @@
+package downloader
+
+import (
+	"context"
+	"github.com/siku2/arigo"
+	"golang.org/x/xerrors"
+	"path/filepath"
+)
+
+// aria2Downloader hands the download to an external aria2 daemon over its RPC interface. aria2 has to be able to
+// write to the download roots under the same paths.
+type aria2Downloader struct {
+	url    string
+	secret string
+}
+
+func (a *aria2Downloader) Download(ctx context.Context, job Job) error {
+	var urls []string
+	for _, url := range job.URLs() {
+		// aria2 makes the requests itself, so they don't pass the rewrites of our transport
+		urls = append(urls, job.Settings.RewriteUrl(url))
+	}
+	if len(urls) == 0 {
+		return xerrors.Errorf("no URL to download %s from", job.PieceCid)
+	}
+
+	client, err := arigo.Dial(a.url, a.secret)
+	if err != nil {
+		return xerrors.Errorf("could not connect to aria2 at %s: %w", a.url, err)
+	}
+	defer client.Close()
+
+	status, err := client.DownloadWithContext(ctx, urls, &arigo.Options{
+		Dir:                    filepath.Dir(job.Filename),
+		Out:                    filepath.Base(job.Filename),
+		Continue:               true,
+		Split:                  uint(job.Settings.Parallelism),
+		MaxConnectionPerServer: uint(min(job.Settings.Parallelism, 16)), // the most aria2 allows
+		MaxTries:               uint(job.Settings.Retries + 1),
+		Timeout:                uint(job.Settings.Timeout.Seconds()),
+	})
+	if err != nil {
+		return err
+	}
+	if status.Status != arigo.StatusCompleted {
+		return xerrors.Errorf("aria2 download %s: %s", status.Status, status.ErrorMessage)
+	}
+	return nil
+}
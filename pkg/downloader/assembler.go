@@ -0,0 +1,17 @@
+package downloader
+
+import (
+	"context"
+	"golang.org/x/xerrors"
+)
+
+// assembler downloads the segments in the manifest of the piece and assembles them into the piece
+type assembler struct{}
+
+func (a *assembler) Download(ctx context.Context, job Job) error {
+	if job.Manifest == nil {
+		return xerrors.Errorf("no manifest for %s", job.ProposalID)
+	}
+	// The assembler picks up the segments that are already in place
+	return job.Manifest.StartDownload(ctx, job.Filename, true, job.Settings.Parallelism, int(job.Settings.Timeout.Seconds()), false, job.Settings.Retries)
+}
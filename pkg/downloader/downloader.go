@@ -0,0 +1,97 @@
+package downloader
+
+import (
+	"context"
+	"filecoin-spade-client/pkg/config"
+	fildatasegment "github.com/ribasushi/fil-datasegment/pkg/dlass"
+	"golang.org/x/xerrors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Downloader writes a piece to a local file
+type Downloader interface {
+	// Download writes the piece of the job to its filename, continuing where an earlier attempt left off when
+	// possible
+	Download(ctx context.Context, job Job) error
+}
+
+// Job is a single piece to download
+type Job struct {
+	ProposalID string
+	PieceCid   string
+	PieceCidV2 string
+	Manifest   *fildatasegment.Agg
+	Sources    []string // URLs of the whole piece
+	Filename   string
+	Settings   config.DownloadConfig // with the overrides for the tenant applied
+}
+
+const (
+	BackendAssembler = "assembler"
+	BackendHttp      = "http"
+	BackendLocal     = "local"
+	BackendAria2     = "aria2"
+)
+
+var Backends = []string{BackendAssembler, BackendHttp, BackendLocal, BackendAria2}
+
+// New returns the download backend with the given name. The http backend makes its requests with the given client.
+func New(name string, config config.DownloadConfig, client *http.Client) (Downloader, error) {
+	switch name {
+	case BackendAssembler, "":
+		return &assembler{}, nil
+	case BackendHttp:
+		return &httpDownloader{client: client}, nil
+	case BackendLocal:
+		if config.LocalPiecePath == "" {
+			return nil, xerrors.Errorf("the %s download backend needs a local piece path", name)
+		}
+		return &localDownloader{pathTemplate: config.LocalPiecePath}, nil
+	case BackendAria2:
+		return &aria2Downloader{url: config.Aria2Url, secret: config.Aria2Secret}, nil
+	}
+	return nil, xerrors.Errorf("unknown download backend %q, expected one of %v", name, Backends)
+}
+
+// Select returns the name of the backend for a deal of the tenant with the given sources: the one configured for
+// the tenant, for the host of one of the sources, or the default
+func Select(config config.DownloadConfig, tenant int16, sources []string) string {
+	if backend, ok := config.TenantBackends[tenant]; ok {
+		return backend
+	}
+	for _, source := range sources {
+		if backend, ok := config.HostBackends[Host(source)]; ok {
+			return backend
+		}
+	}
+	return config.Backend
+}
+
+// URLs returns where the whole piece can be fetched: the configured piece URL, or else the sources of the piece
+// in Spade
+func (j Job) URLs() []string {
+	if j.Settings.PieceUrl != "" {
+		return []string{Expand(j.Settings.PieceUrl, j)}
+	}
+	return j.Sources
+}
+
+// Expand fills in the {piece_cid}, {pcid_v2} and {proposal_id} placeholders of a URL or path template
+func Expand(template string, job Job) string {
+	return strings.NewReplacer(
+		"{piece_cid}", job.PieceCid,
+		"{pcid_v2}", job.PieceCidV2,
+		"{proposal_id}", job.ProposalID,
+	).Replace(template)
+}
+
+// Host returns the host of a source URL, or the source itself when it isn't a URL
+func Host(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return source
+	}
+	return u.Hostname()
+}
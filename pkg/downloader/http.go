@@ -0,0 +1,82 @@
+package downloader
+
+import (
+	"context"
+	"filecoin-spade-client/pkg/log"
+	"fmt"
+	"golang.org/x/xerrors"
+	"io"
+	"net/http"
+	"os"
+)
+
+// httpDownloader fetches the whole piece from a single URL, resuming a partial download with a range request
+type httpDownloader struct {
+	client *http.Client
+}
+
+func (h *httpDownloader) Download(ctx context.Context, job Job) error {
+	urls := job.URLs()
+	if len(urls) == 0 {
+		return xerrors.Errorf("no URL to download %s from", job.PieceCid)
+	}
+
+	var err error
+	for attempt := 0; attempt <= job.Settings.Retries; attempt++ {
+		url := urls[attempt%len(urls)]
+		err = h.fetch(ctx, url, job.Filename)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		log.Warnf(" > Downloading %s from %s failed: %s", job.ProposalID, url, err)
+	}
+	return err
+}
+
+func (h *httpDownloader) fetch(ctx context.Context, url string, filename string) error {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// No support for ranges, start over
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Already complete
+		return nil
+	default:
+		return xerrors.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	_, err = io.Copy(file, resp.Body)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
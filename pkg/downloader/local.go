@@ -0,0 +1,55 @@
+package downloader
+
+import (
+	"context"
+	"golang.org/x/xerrors"
+	"io"
+	"os"
+)
+
+// localDownloader copies the piece from a local or network mounted path, e.g. an NFS share
+type localDownloader struct {
+	pathTemplate string
+}
+
+func (l *localDownloader) Download(ctx context.Context, job Job) error {
+	source, err := os.Open(Expand(l.pathTemplate, job))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	file, err := os.OpenFile(job.Filename, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Continue after what was copied before
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := source.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, &contextReader{ctx: ctx, reader: source})
+	if err != nil {
+		return xerrors.Errorf("could not copy %s: %w", source.Name(), err)
+	}
+	return file.Sync()
+}
+
+// contextReader stops reading when the context is done
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
@@ -15,6 +15,13 @@ import (
 	"time"
 )
 
+const (
+	// Mainnet genesis, to convert epochs to time
+	GenesisTimestamp = 1598306400
+	// Seconds per epoch
+	EpochDuration = 30
+)
+
 type LotusClient struct {
 	Config   config.LotusConfig
 	Api      lotusapi.FullNodeStruct
@@ -22,6 +29,7 @@ type LotusClient struct {
 
 	MinerAddress  address.Address
 	WorkerAddress address.Address
+	SectorSize    abi.SectorSize
 }
 
 func New(config config.Configuration) *LotusClient {
@@ -69,7 +77,7 @@ func (lc *LotusClient) connectLotusDaemon(ctx context.Context) {
 	}
 
 	// Expected mainnet epoch
-	expectedEpoch := uint64((time.Now().Unix() - 1598306400) / 30)
+	expectedEpoch := uint64((time.Now().Unix() - GenesisTimestamp) / EpochDuration)
 	actualBehind := expectedEpoch - nodestatus.SyncStatus.Epoch
 
 	if nodestatus.SyncStatus.Behind > 5 || actualBehind > 5 {
@@ -133,8 +141,9 @@ func (lc *LotusClient) connectLotusMiner(ctx context.Context) {
 	}
 
 	lc.WorkerAddress = minerInfo.Worker
+	lc.SectorSize = minerInfo.SectorSize
 
-	log.Infof("Successfully connected to lotus miner node, Miner Address: %s, Worker %s", lc.MinerAddress, lc.WorkerAddress)
+	log.Infof("Successfully connected to lotus miner node, Miner Address: %s, Worker %s, Sector size %s", lc.MinerAddress, lc.WorkerAddress, lc.SectorSize.ShortString())
 
 	go func() {
 		select {
@@ -0,0 +1,194 @@
+package piececache
+
+import (
+	"filecoin-spade-client/pkg/log"
+	"github.com/dustin/go-humanize"
+	"golang.org/x/xerrors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tempSuffix = ".tmp"
+
+// Cache keeps verified pieces by piece CID, so a piece that is proposed again doesn't have to be downloaded again.
+// Pieces are hardlinked in and out of the cache when it is on the same filesystem, and copied otherwise. The
+// modification time of a cached piece is its last use, the least recently used pieces are evicted when the cache
+// grows beyond its size.
+type Cache struct {
+	path    string
+	maxSize uint64
+
+	mutex sync.Mutex
+}
+
+func New(path string, maxSize uint64) (*Cache, error) {
+	err := os.MkdirAll(path, 0o755)
+	if err != nil {
+		return nil, xerrors.Errorf("could not create the piece cache in %s: %w", path, err)
+	}
+
+	c := &Cache{path: filepath.Clean(path), maxSize: maxSize}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Clean up copies that were interrupted
+	entries, err := os.ReadDir(c.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), tempSuffix) {
+			_ = os.Remove(filepath.Join(c.path, entry.Name()))
+		}
+	}
+	c.evict(0)
+	return c, nil
+}
+
+func (c *Cache) filename(pieceCid string) string {
+	return filepath.Join(c.path, pieceCid)
+}
+
+// Restore puts the cached piece at the given filename and marks it as used. It returns false when the piece isn't
+// in the cache.
+func (c *Cache) Restore(pieceCid string, filename string) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cached := c.filename(pieceCid)
+	if _, err := os.Stat(cached); err != nil {
+		return false, nil
+	}
+	now := time.Now()
+	_ = os.Chtimes(cached, now, now)
+
+	_ = os.Remove(filename)
+	err := linkOrCopy(cached, filename)
+	if err != nil {
+		return false, xerrors.Errorf("could not restore %s from the piece cache: %w", pieceCid, err)
+	}
+	return true, nil
+}
+
+// Add puts a verified piece in the cache, evicting the least recently used pieces to make room for it. Pieces
+// larger than the cache are not added.
+func (c *Cache) Add(pieceCid string, filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if uint64(info.Size()) > c.maxSize {
+		log.Debugf("Not caching %s, it is larger than the piece cache", pieceCid)
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cached := c.filename(pieceCid)
+	now := time.Now()
+	if _, err := os.Stat(cached); err == nil {
+		_ = os.Chtimes(cached, now, now)
+		return nil
+	}
+
+	c.evict(uint64(info.Size()))
+	err = linkOrCopy(filename, cached)
+	if err != nil {
+		return xerrors.Errorf("could not add %s to the piece cache: %w", pieceCid, err)
+	}
+	_ = os.Chtimes(cached, now, now)
+	log.Infof("Added %s (%s) to the piece cache", pieceCid, humanize.IBytes(uint64(info.Size())))
+	return nil
+}
+
+// Size returns the bytes the cached pieces take up
+func (c *Cache) Size() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	size := uint64(0)
+	for _, entry := range c.entries() {
+		size += uint64(entry.Size())
+	}
+	return size
+}
+
+// entries returns the cached pieces, least recently used first
+func (c *Cache) entries() []os.FileInfo {
+	dirEntries, err := os.ReadDir(c.path)
+	if err != nil {
+		log.Warnf("Could not list the piece cache: %s", err)
+		return nil
+	}
+	var entries []os.FileInfo
+	for _, entry := range dirEntries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), tempSuffix) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			entries = append(entries, info)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime().Before(entries[j].ModTime()) })
+	return entries
+}
+
+// evict removes the least recently used pieces until there is room for the given amount of bytes
+func (c *Cache) evict(room uint64) {
+	entries := c.entries()
+	size := uint64(0)
+	for _, entry := range entries {
+		size += uint64(entry.Size())
+	}
+
+	for _, entry := range entries {
+		if size+room <= c.maxSize {
+			return
+		}
+		err := os.Remove(filepath.Join(c.path, entry.Name()))
+		if err != nil {
+			log.Warnf("Could not evict %s from the piece cache: %s", entry.Name(), err)
+			continue
+		}
+		log.Infof("Evicted %s (%s) from the piece cache, last used %s", entry.Name(), humanize.IBytes(uint64(entry.Size())), entry.ModTime().Format(time.RFC3339))
+		size -= uint64(entry.Size())
+	}
+}
+
+// linkOrCopy hardlinks the file, or copies it when that isn't possible (e.g. on another filesystem). A copy only
+// appears at the destination once it is complete.
+func linkOrCopy(from string, to string) error {
+	if err := os.Link(from, to); err == nil {
+		return nil
+	}
+
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	temp := to + tempSuffix
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyBuffer(file, source, make([]byte, 4<<20))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, to)
+}
@@ -0,0 +1,151 @@
+package schedule
+
+import (
+	"golang.org/x/xerrors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a recurring period of time on some days of the week, in local time. A window that ends before it
+// starts runs past midnight, into the next day.
+type Window struct {
+	Days  [7]bool
+	Start time.Duration // since midnight
+	End   time.Duration // since midnight
+	spec  string
+}
+
+// ParseWindow parses a window like "Mon-Fri 17:00-21:00", "Sat,Sun 00:00-24:00" or "22:00-06:00" (every day)
+func ParseWindow(spec string) (Window, error) {
+	w := Window{spec: spec}
+
+	fields := strings.Fields(spec)
+	var days, hours string
+	switch len(fields) {
+	case 1:
+		days, hours = "*", fields[0]
+	case 2:
+		days, hours = fields[0], fields[1]
+	default:
+		return w, xerrors.Errorf("invalid window %q, expected [Days] HH:MM-HH:MM", spec)
+	}
+
+	err := w.parseDays(days)
+	if err != nil {
+		return w, xerrors.Errorf("invalid window %q: %s", spec, err)
+	}
+
+	start, end, found := strings.Cut(hours, "-")
+	if !found {
+		return w, xerrors.Errorf("invalid window %q, expected HH:MM-HH:MM", spec)
+	}
+	w.Start, err = parseTimeOfDay(start)
+	if err == nil {
+		w.End, err = parseTimeOfDay(end)
+	}
+	if err != nil {
+		return w, xerrors.Errorf("invalid window %q: %s", spec, err)
+	}
+	if w.Start == w.End {
+		return w, xerrors.Errorf("invalid window %q, it starts and ends at the same time", spec)
+	}
+	return w, nil
+}
+
+func ParseWindows(specs []string) ([]Window, error) {
+	var windows []Window
+	for _, spec := range specs {
+		w, err := ParseWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func (w *Window) parseDays(days string) error {
+	if days == "*" {
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+		return nil
+	}
+
+	for _, part := range strings.Split(strings.ToLower(days), ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := weekdays[from]
+		if !ok {
+			return xerrors.Errorf("unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			last, ok = weekdays[to]
+			if !ok {
+				return xerrors.Errorf("unknown day %q", to)
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			w.Days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	hours, minutes, found := strings.Cut(value, ":")
+	if !found {
+		return 0, xerrors.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 24 {
+		return 0, xerrors.Errorf("invalid hour in %q", value)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, xerrors.Errorf("invalid minutes in %q", value)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// Contains returns whether t falls within the window
+func (w Window) Contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	sinceMidnight := t.Sub(midnight)
+
+	if w.Start < w.End {
+		return w.Days[t.Weekday()] && sinceMidnight >= w.Start && sinceMidnight < w.End
+	}
+
+	// Runs past midnight: either the start of today's window, or the end of yesterday's
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.Days[t.Weekday()] && sinceMidnight >= w.Start) || (w.Days[yesterday] && sinceMidnight < w.End)
+}
+
+func (w Window) String() string {
+	return w.spec
+}
+
+// Active returns the first of the windows that contains t
+func Active(windows []Window, t time.Time) (Window, bool) {
+	for _, w := range windows {
+		if w.Contains(t) {
+			return w, true
+		}
+	}
+	return Window{}, false
+}
@@ -0,0 +1,114 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		spec    string
+		days    string // the days in the window, Sunday first
+		start   time.Duration
+		end     time.Duration
+		invalid bool
+	}{
+		{spec: "Mon-Fri 17:00-21:00", days: "-MTWTF-", start: 17 * time.Hour, end: 21 * time.Hour},
+		{spec: "Sat,Sun 00:00-24:00", days: "S-----S", start: 0, end: 24 * time.Hour},
+		{spec: "22:00-06:00", days: "SMTWTFS", start: 22 * time.Hour, end: 6 * time.Hour},
+		{spec: "Fri-Mon 10:30-12:00", days: "SM---FS", start: 10*time.Hour + 30*time.Minute, end: 12 * time.Hour},
+		{spec: "sat-sun,wed 01:00-02:00", days: "S--W--S", start: time.Hour, end: 2 * time.Hour},
+		{spec: "Mon 09:00-09:00", invalid: true},
+		{spec: "Mon 24:30-25:00", invalid: true},
+		{spec: "Mon 09:60-10:00", invalid: true},
+		{spec: "Mon 09:00", invalid: true},
+		{spec: "Funday 09:00-10:00", invalid: true},
+		{spec: "Mon-Funday 09:00-10:00", invalid: true},
+		{spec: "Mon 09:00-10:00 extra", invalid: true},
+	}
+
+	for _, test := range tests {
+		w, err := ParseWindow(test.spec)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.spec, err)
+			continue
+		}
+		if days := formatDays(w.Days); days != test.days {
+			t.Errorf("%q: days %s, expected %s", test.spec, days, test.days)
+		}
+		if w.Start != test.start || w.End != test.end {
+			t.Errorf("%q: %s-%s, expected %s-%s", test.spec, w.Start, w.End, test.start, test.end)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		spec     string
+		t        time.Time
+		contains bool
+	}{
+		{"Mon-Fri 17:00-21:00", at(1, 17, 0), true},
+		{"Mon-Fri 17:00-21:00", at(1, 20, 59), true},
+		{"Mon-Fri 17:00-21:00", at(1, 21, 0), false},
+		{"Mon-Fri 17:00-21:00", at(1, 16, 59), false},
+		{"Mon-Fri 17:00-21:00", at(6, 18, 0), false}, // Saturday
+
+		// Past midnight, every day
+		{"22:00-06:00", at(1, 23, 0), true},
+		{"22:00-06:00", at(2, 5, 59), true},
+		{"22:00-06:00", at(2, 6, 0), false},
+		{"22:00-06:00", at(2, 12, 0), false},
+
+		// Past midnight: the morning belongs to the window of the day before
+		{"Fri 22:00-06:00", at(5, 22, 0), true},
+		{"Fri 22:00-06:00", at(6, 3, 0), true},  // Saturday morning
+		{"Fri 22:00-06:00", at(5, 3, 0), false}, // Friday morning, Thursday has no window
+		{"Fri 22:00-06:00", at(6, 22, 0), false},
+
+		// Day ranges that wrap around the end of the week
+		{"Fri-Mon 10:00-12:00", at(5, 11, 0), true},
+		{"Fri-Mon 10:00-12:00", at(6, 11, 0), true},
+		{"Fri-Mon 10:00-12:00", at(7, 11, 0), true},
+		{"Fri-Mon 10:00-12:00", at(8, 11, 0), true},
+		{"Fri-Mon 10:00-12:00", at(3, 11, 0), false}, // Wednesday
+		{"Fri-Mon 10:00-12:00", at(4, 11, 0), false}, // Thursday
+
+		// Both: the window of Monday night ends on Tuesday morning
+		{"Sat-Mon 23:00-01:00", at(9, 0, 30), true},   // Tuesday
+		{"Sat-Mon 23:00-01:00", at(10, 0, 30), false}, // Wednesday
+		{"Sat-Mon 23:00-01:00", at(6, 0, 30), false},  // Saturday, Friday has no window
+		{"Sat-Mon 23:00-01:00", at(7, 0, 30), true},   // Sunday
+	}
+
+	for _, test := range tests {
+		w, err := ParseWindow(test.spec)
+		if err != nil {
+			t.Fatalf("%q: %s", test.spec, err)
+		}
+		if contains := w.Contains(test.t); contains != test.contains {
+			t.Errorf("%q contains %s: %t, expected %t", test.spec, test.t.Format("Mon 15:04"), contains, test.contains)
+		}
+	}
+}
+
+func formatDays(days [7]bool) string {
+	letters := []byte("SMTWTFS")
+	for i, in := range days {
+		if !in {
+			letters[i] = '-'
+		}
+	}
+	return string(letters)
+}
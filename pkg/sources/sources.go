@@ -0,0 +1,277 @@
+package sources
+
+import (
+	"context"
+	"errors"
+	"filecoin-spade-client/pkg/config"
+	"filecoin-spade-client/pkg/downloader"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"golang.org/x/xerrors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Weight of the latest request in the moving averages
+const smoothing = 0.2
+
+// Requests a host needs before its error rate is trusted
+const minRequests = 5
+
+type downloadKey struct{}
+
+// HostStats are the statistics of the requests to a source host, across deals
+type HostStats struct {
+	Requests    uint64    `json:"requests"`
+	Errors      uint64    `json:"errors"` // failed requests and error responses, without timeouts
+	Timeouts    uint64    `json:"timeouts"`
+	Bytes       uint64    `json:"bytes"`
+	ErrorRate   float64   `json:"error_rate"` // moving average
+	Throughput  float64   `json:"throughput"` // moving average of bytes per second of complete responses, while they are read
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+}
+
+// Score is higher for hosts that are faster and fail less
+func (s HostStats) Score() float64 {
+	return s.Throughput * (1 - s.ErrorRate)
+}
+
+func (s HostStats) String() string {
+	return fmt.Sprintf("%d requests, %.0f%% errors, %d timeouts, %s/s", s.Requests, s.ErrorRate*100, s.Timeouts, humanize.IBytes(uint64(s.Throughput)))
+}
+
+// Tracker keeps the statistics of the source hosts, and applies the configured allow and deny lists and rewrite
+// rules to download requests
+type Tracker struct {
+	config config.DownloadConfig
+
+	mutex sync.Mutex
+	hosts map[string]*HostStats
+}
+
+func New(config config.DownloadConfig) *Tracker {
+	return &Tracker{config: config, hosts: make(map[string]*HostStats)}
+}
+
+// Load replaces the statistics, e.g. with the ones from before a restart
+func (t *Tracker) Load(stats map[string]HostStats) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.hosts = make(map[string]*HostStats)
+	for host, s := range stats {
+		s := s
+		t.hosts[host] = &s
+	}
+}
+
+// Stats returns a copy of the statistics by host
+func (t *Tracker) Stats() map[string]HostStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	stats := make(map[string]HostStats, len(t.hosts))
+	for host, s := range t.hosts {
+		stats[host] = *s
+	}
+	return stats
+}
+
+// Avoided returns whether the host failed too often recently to send it requests
+func (t *Tracker) Avoided(host string) bool {
+	if t.config.SourceMaxErrorRate <= 0 {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s, ok := t.hosts[host]
+	if !ok || s.Requests < minRequests {
+		return false
+	}
+	return s.ErrorRate > t.config.SourceMaxErrorRate && time.Since(s.LastErrorAt) < t.config.SourceCooldown
+}
+
+// Order returns the allowed sources, the most preferred first. Hosts without statistics are scored as the
+// average of the known hosts, so they get tried as well.
+func (t *Tracker) Order(sources []string) []string {
+	stats := t.Stats()
+	known := 0.0
+	for _, s := range stats {
+		known += s.Score()
+	}
+	if len(stats) > 0 {
+		known /= float64(len(stats))
+	}
+
+	score := func(source string) float64 {
+		host := downloader.Host(source)
+		if t.Avoided(host) {
+			return -1
+		}
+		if s, ok := stats[host]; ok {
+			return s.Score()
+		}
+		return known
+	}
+
+	var ordered []string
+	for _, source := range sources {
+		if t.config.HostAllowed(downloader.Host(source)) {
+			ordered = append(ordered, source)
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool { return score(ordered[i]) > score(ordered[j]) })
+	return ordered
+}
+
+// WithDownload returns a context for a download, only requests made with it are tracked, rewritten and checked
+// against the allow and deny lists
+func (t *Tracker) WithDownload(ctx context.Context) context.Context {
+	return context.WithValue(ctx, downloadKey{}, true)
+}
+
+func (t *Tracker) record(host string, bytes uint64, elapsed time.Duration, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	s, ok := t.hosts[host]
+	if !ok {
+		s = new(HostStats)
+		t.hosts[host] = s
+	}
+	s.Requests++
+	s.Bytes += bytes
+
+	failed := 0.0
+	if err != nil {
+		failed = 1
+		if isTimeout(err) {
+			s.Timeouts++
+		} else {
+			s.Errors++
+		}
+		s.LastError = err.Error()
+		s.LastErrorAt = time.Now()
+	} else if elapsed > 0 {
+		throughput := float64(bytes) / elapsed.Seconds()
+		if s.Throughput == 0 {
+			s.Throughput = throughput
+		} else {
+			s.Throughput += smoothing * (throughput - s.Throughput)
+		}
+	}
+	if s.Requests == 1 {
+		s.ErrorRate = failed
+	} else {
+		s.ErrorRate += smoothing * (failed - s.ErrorRate)
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// Transport wraps next, tracking, rewriting and checking the requests made for downloads
+func (t *Tracker) Transport(next http.RoundTripper) http.RoundTripper {
+	return &transport{tracker: t, next: next}
+}
+
+type transport struct {
+	tracker *Tracker
+	next    http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Value(downloadKey{}) == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	host := req.URL.Hostname()
+	if !t.tracker.config.HostAllowed(host) {
+		return nil, xerrors.Errorf("downloads from %s are not allowed", host)
+	}
+	if t.tracker.Avoided(host) {
+		return nil, xerrors.Errorf("skipping %s, it failed too often recently", host)
+	}
+
+	if rewritten := t.tracker.config.RewriteUrl(req.URL.String()); rewritten != req.URL.String() {
+		u, err := url.Parse(rewritten)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid rewritten URL %s: %w", rewritten, err)
+		}
+		req = req.Clone(req.Context())
+		req.URL = u
+		req.Host = ""
+	}
+
+	started := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		// A cancelled download says nothing about the host
+		if !errors.Is(err, context.Canceled) {
+			t.tracker.record(host, 0, 0, err)
+		}
+		return resp, err
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.tracker.record(host, 0, 0, xerrors.Errorf("%s", resp.Status))
+		return resp, nil
+	}
+	resp.Body = &body{ReadCloser: resp.Body, ctx: req.Context(), tracker: t.tracker, host: host, length: resp.ContentLength, elapsed: time.Since(started)}
+	return resp, nil
+}
+
+// body records the response once it is read completely, fails, or is closed before that. The time between reads
+// (e.g. waiting for the bandwidth limit, or for the reader to catch up) doesn't count towards the throughput.
+type body struct {
+	io.ReadCloser
+	ctx      context.Context
+	tracker  *Tracker
+	host     string
+	length   int64         // -1 when unknown
+	elapsed  time.Duration // waiting for the response and reading it
+	bytes    uint64
+	recorded bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	started := time.Now()
+	n, err := b.ReadCloser.Read(p)
+	b.elapsed += time.Since(started)
+	b.bytes += uint64(n)
+	if err == io.EOF {
+		b.done(nil)
+	} else if err != nil {
+		b.done(err)
+	}
+	return n, err
+}
+
+func (b *body) Close() error {
+	if b.length >= 0 && b.bytes >= uint64(b.length) {
+		b.done(nil)
+	} else {
+		// Abandoned halfway, e.g. because of a timeout
+		b.done(xerrors.New("response not read completely"))
+	}
+	return b.ReadCloser.Close()
+}
+
+func (b *body) done(err error) {
+	if b.recorded {
+		return
+	}
+	b.recorded = true
+	switch {
+	case err == nil:
+		b.tracker.record(b.host, b.bytes, b.elapsed, nil)
+	case errors.Is(b.ctx.Err(), context.Canceled):
+	default:
+		b.tracker.record(b.host, b.bytes, 0, err)
+	}
+}
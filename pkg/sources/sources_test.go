@@ -0,0 +1,55 @@
+package sources
+
+import (
+	"bytes"
+	"context"
+	"filecoin-spade-client/pkg/config"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type staticTransport []byte
+
+func (t staticTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, ContentLength: int64(len(t)), Body: io.NopCloser(bytes.NewReader(t))}, nil
+}
+
+func TestThroughputExcludesPauses(t *testing.T) {
+	data := make([]byte, 4<<20)
+	tracker := New(config.DownloadConfig{})
+	client := &http.Client{Transport: tracker.Transport(staticTransport(data))}
+
+	req, err := http.NewRequestWithContext(tracker.WithDownload(context.Background()), http.MethodGet, "http://source.example/piece", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A slow reader, e.g. waiting for the bandwidth limit
+	buf := make([]byte, 1<<20)
+	for {
+		_, err := resp.Body.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	resp.Body.Close()
+	wallClock := float64(len(data)) / time.Since(started).Seconds()
+
+	s := tracker.Stats()["source.example"]
+	if s.Requests != 1 || s.Bytes != uint64(len(data)) {
+		t.Fatalf("recorded %d requests and %d bytes, expected 1 and %d", s.Requests, s.Bytes, len(data))
+	}
+	if s.Throughput < 10*wallClock {
+		t.Fatalf("throughput %.0f B/s includes the pauses of the reader, %.0f B/s by the wall clock", s.Throughput, wallClock)
+	}
+}
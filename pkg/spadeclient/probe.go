@@ -0,0 +1,143 @@
+package spadeclient
+
+import (
+	"context"
+	"filecoin-spade-client/pkg/config"
+	"fmt"
+	"golang.org/x/xerrors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SourceProber checks whether the sources of a piece respond before it is reserved, so we don't spend a
+// reservation on a piece nobody can deliver. Results are remembered per piece for a while.
+type SourceProber struct {
+	config   config.SpadeConfig
+	download config.DownloadConfig
+	client   *http.Client
+
+	mutex   sync.Mutex
+	results map[string]probeResult
+}
+
+type probeResult struct {
+	reason string // empty when a source is reachable
+	at     time.Time
+}
+
+func NewSourceProber(config config.Configuration) *SourceProber {
+	return &SourceProber{
+		config:   config.SpadeConfig,
+		download: config.DownloadConfig,
+		client:   &http.Client{Timeout: config.SpadeConfig.ProbeTimeout},
+		results:  make(map[string]probeResult),
+	}
+}
+
+// Reachable probes a sample of the sources of the piece at the same time, and returns whether any of them responds.
+// Otherwise it returns why not. Pieces without HTTP sources can't be probed and count as reachable.
+func (p *SourceProber) Reachable(ctx context.Context, piece *Piece) (bool, string) {
+	p.mutex.Lock()
+	result, ok := p.results[piece.PieceCid]
+	p.mutex.Unlock()
+	if ok && time.Since(result.at) < p.config.ProbeCacheDuration {
+		return result.reason == "", result.reason
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err().Error()
+	}
+
+	result = probeResult{reason: p.probe(ctx, piece), at: time.Now()}
+	if ctx.Err() != nil {
+		return false, ctx.Err().Error()
+	}
+	p.mutex.Lock()
+	p.results[piece.PieceCid] = result
+	for pieceCid, old := range p.results {
+		if time.Since(old.at) >= p.config.ProbeCacheDuration {
+			delete(p.results, pieceCid)
+		}
+	}
+	p.mutex.Unlock()
+	return result.reason == "", result.reason
+}
+
+func (p *SourceProber) probe(ctx context.Context, piece *Piece) string {
+	probeable := 0
+	var sources []string
+	for _, source := range piece.Sources {
+		u, err := url.Parse(source)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		probeable++
+		if p.download.HostAllowed(u.Hostname()) {
+			sources = append(sources, source)
+		}
+	}
+	if probeable == 0 {
+		return ""
+	}
+	if len(sources) == 0 {
+		return "no allowed sources"
+	}
+
+	rand.Shuffle(len(sources), func(i, j int) { sources[i], sources[j] = sources[j], sources[i] })
+	if p.config.ProbeSamples > 0 && len(sources) > p.config.ProbeSamples {
+		sources = sources[:p.config.ProbeSamples]
+	}
+
+	probeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(sources))
+	for _, source := range sources {
+		go func(source string) {
+			errs <- p.probeSource(probeCtx, p.download.RewriteUrl(source))
+		}(source)
+	}
+
+	var failures []string
+	for range sources {
+		err := <-errs
+		if err == nil {
+			return ""
+		}
+		failures = append(failures, err.Error())
+	}
+	return fmt.Sprintf("none of %d sources reachable: %s", len(sources), strings.Join(failures, "; "))
+}
+
+// probeSource asks for the headers of a source, and falls back to its first byte when HEAD isn't supported
+func (p *SourceProber) probeSource(ctx context.Context, source string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, source, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", "bytes=0-0")
+		resp, err = p.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return xerrors.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
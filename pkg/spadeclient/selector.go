@@ -0,0 +1,192 @@
+package spadeclient
+
+import (
+	"golang.org/x/xerrors"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// PieceSelector decides in which order the eligible pieces are tried for a reservation
+type PieceSelector interface {
+	// Order returns the pieces in the order they should be tried, without modifying the given slice
+	Order(pieces []*Piece) []*Piece
+	// Reserved is called after a piece was successfully reserved for the tenant
+	Reserved(piece *Piece, tenant int16)
+}
+
+const (
+	SelectFirstFit          = "first-fit"
+	SelectRandom            = "random"
+	SelectTenantRoundRobin  = "tenant-round-robin"
+	SelectSmallestFirst     = "smallest-first"
+	SelectLargestFirst      = "largest-first"
+	SelectFewestSourcesLast = "fewest-sources-last"
+)
+
+const defaultTenantWeight = 1
+
+var PieceSelectors = []string{SelectFirstFit, SelectRandom, SelectTenantRoundRobin, SelectSmallestFirst, SelectLargestFirst, SelectFewestSourcesLast}
+
+// NewPieceSelector returns the selection strategy with the given name. Tenant weights are only used by the
+// tenant round-robin strategy, tenants without a weight get a weight of 1.
+func NewPieceSelector(name string, tenantWeights map[int16]int) (PieceSelector, error) {
+	switch name {
+	case SelectFirstFit, "":
+		return &sortingSelector{}, nil
+	case SelectRandom:
+		return &randomSelector{}, nil
+	case SelectTenantRoundRobin:
+		return newTenantRoundRobinSelector(tenantWeights), nil
+	case SelectSmallestFirst:
+		return &sortingSelector{less: func(a, b *Piece) bool { return a.PaddedPieceSize < b.PaddedPieceSize }}, nil
+	case SelectLargestFirst:
+		return &sortingSelector{less: func(a, b *Piece) bool { return a.PaddedPieceSize > b.PaddedPieceSize }}, nil
+	case SelectFewestSourcesLast:
+		return &sortingSelector{less: func(a, b *Piece) bool { return len(a.Sources) > len(b.Sources) }}, nil
+	}
+	return nil, xerrors.Errorf("unknown piece selection strategy %q, expected one of %v", name, PieceSelectors)
+}
+
+// sortingSelector orders pieces by a fixed criterion, keeping Spade's order for equal pieces. Without a
+// criterion Spade's order is used as is (first-fit).
+type sortingSelector struct {
+	less func(a, b *Piece) bool
+}
+
+func (s *sortingSelector) Order(pieces []*Piece) []*Piece {
+	ordered := make([]*Piece, len(pieces))
+	copy(ordered, pieces)
+	if s.less != nil {
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return s.less(ordered[i], ordered[j])
+		})
+	}
+	return ordered
+}
+
+func (s *sortingSelector) Reserved(piece *Piece, tenant int16) {}
+
+type randomSelector struct{}
+
+func (s *randomSelector) Order(pieces []*Piece) []*Piece {
+	ordered := make([]*Piece, len(pieces))
+	copy(ordered, pieces)
+	rand.Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+	return ordered
+}
+
+func (s *randomSelector) Reserved(piece *Piece, tenant int16) {}
+
+// tenantRoundRobinSelector spreads reservations over the tenants using smooth weighted round-robin, so a tenant
+// with weight 3 gets three reservations for every one of a tenant with weight 1
+type tenantRoundRobinSelector struct {
+	mutex   sync.Mutex
+	weights map[int16]int
+	current map[int16]int
+	tenants []int16 // tenants seen in the last ordering
+}
+
+func newTenantRoundRobinSelector(weights map[int16]int) *tenantRoundRobinSelector {
+	s := new(tenantRoundRobinSelector)
+	s.weights = weights
+	s.current = make(map[int16]int)
+	return s
+}
+
+func (s *tenantRoundRobinSelector) weight(tenant int16) int {
+	if weight, ok := s.weights[tenant]; ok {
+		return weight
+	}
+	return defaultTenantWeight
+}
+
+// next picks the tenant that is up next and updates the current weights accordingly
+func (s *tenantRoundRobinSelector) next(current map[int16]int, tenants []int16) int16 {
+	total := 0
+	best := tenants[0]
+	for _, tenant := range tenants {
+		current[tenant] += s.weight(tenant)
+		total += s.weight(tenant)
+		if current[tenant] > current[best] {
+			best = tenant
+		}
+	}
+	current[best] -= total
+	return best
+}
+
+func (s *tenantRoundRobinSelector) Order(pieces []*Piece) []*Piece {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	perTenant := make(map[int16][]*Piece)
+	var tenants []int16
+	for _, piece := range pieces {
+		tenant := pieceTenant(piece)
+		if _, ok := perTenant[tenant]; !ok {
+			tenants = append(tenants, tenant)
+		}
+		perTenant[tenant] = append(perTenant[tenant], piece)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i] < tenants[j] })
+	s.tenants = tenants
+
+	// Simulate the round-robin on a copy of the weights to interleave the tenants
+	current := make(map[int16]int)
+	for tenant, weight := range s.current {
+		current[tenant] = weight
+	}
+	ordered := make([]*Piece, 0, len(pieces))
+	remaining := tenants
+	for len(remaining) > 0 {
+		tenant := s.next(current, remaining)
+		ordered = append(ordered, perTenant[tenant][0])
+		perTenant[tenant] = perTenant[tenant][1:]
+
+		if len(perTenant[tenant]) == 0 {
+			var left []int16
+			for _, t := range remaining {
+				if t != tenant {
+					left = append(left, t)
+				}
+			}
+			remaining = left
+		}
+	}
+	return ordered
+}
+
+func (s *tenantRoundRobinSelector) Reserved(piece *Piece, tenant int16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tenants := s.tenants
+	found := false
+	for _, t := range tenants {
+		if t == tenant {
+			found = true
+			break
+		}
+	}
+	if !found {
+		tenants = append(tenants, tenant)
+	}
+
+	// Move the round-robin forward, crediting the tenant that actually got the reservation
+	total := 0
+	for _, t := range tenants {
+		s.current[t] += s.weight(t)
+		total += s.weight(t)
+	}
+	s.current[tenant] -= total
+}
+
+func pieceTenant(piece *Piece) int16 {
+	if len(piece.ClaimingTenants) == 0 {
+		return 0
+	}
+	return piece.ClaimingTenants[0]
+}
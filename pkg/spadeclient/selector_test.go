@@ -0,0 +1,99 @@
+package spadeclient
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTenantRoundRobinSelector(t *testing.T) {
+	firstTenant := func(piece *Piece) int16 { return piece.ClaimingTenants[0] }
+	lastTenant := func(piece *Piece) int16 { return piece.ClaimingTenants[len(piece.ClaimingTenants)-1] }
+
+	tests := []struct {
+		name     string
+		weights  map[int16]int
+		pieces   map[string][]int16 // claiming tenants by piece CID
+		tenant   func(piece *Piece) int16
+		rounds   int
+		reserved string // the piece CIDs that get reserved, in order
+	}{
+		{
+			name:     "equal weights",
+			pieces:   map[string][]int16{"a": {1}, "b": {2}},
+			tenant:   firstTenant,
+			rounds:   6,
+			reserved: "ababab",
+		},
+		{
+			name:     "weighted",
+			weights:  map[int16]int{1: 3, 2: 1},
+			pieces:   map[string][]int16{"a": {1}, "b": {2}},
+			tenant:   firstTenant,
+			rounds:   8,
+			reserved: "aabaaaba",
+		},
+		{
+			name:     "weighted three tenants",
+			weights:  map[int16]int{1: 2, 3: 2},
+			pieces:   map[string][]int16{"a": {1}, "b": {2}, "c": {3}},
+			tenant:   firstTenant,
+			rounds:   10,
+			reserved: "acbacacbac",
+		},
+		{
+			// Tenant 1 gets nothing, e.g. because it is over its quota, so it stays up next
+			name:     "credits the tenant the piece is reserved for",
+			pieces:   map[string][]int16{"a": {1, 2}, "b": {2}},
+			tenant:   lastTenant,
+			rounds:   4,
+			reserved: "aaaa",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTenantRoundRobinSelector(test.weights)
+			var pieces []*Piece
+			for _, pieceCid := range []string{"a", "b", "c"} {
+				if tenants, ok := test.pieces[pieceCid]; ok {
+					pieces = append(pieces, &Piece{PieceCid: pieceCid, ClaimingTenants: tenants})
+				}
+			}
+
+			var reserved strings.Builder
+			for i := 0; i < test.rounds; i++ {
+				ordered := s.Order(pieces)
+				if len(ordered) != len(pieces) {
+					t.Fatalf("ordered %d pieces, expected %d", len(ordered), len(pieces))
+				}
+				piece := ordered[0]
+				s.Reserved(piece, test.tenant(piece))
+				reserved.WriteString(piece.PieceCid)
+			}
+			if reserved.String() != test.reserved {
+				t.Fatalf("reserved %s, expected %s", reserved.String(), test.reserved)
+			}
+		})
+	}
+}
+
+func TestTenantRoundRobinOrderInterleaves(t *testing.T) {
+	s := newTenantRoundRobinSelector(map[int16]int{1: 3, 2: 1})
+	var pieces []*Piece
+	for _, piece := range []string{"a1", "a2", "a3", "a4", "a5", "a6", "a7", "b1", "b2"} {
+		tenant := int16(1)
+		if piece[0] == 'b' {
+			tenant = 2
+		}
+		pieces = append(pieces, &Piece{PieceCid: piece, ClaimingTenants: []int16{tenant}})
+	}
+
+	var order []string
+	for _, piece := range s.Order(pieces) {
+		order = append(order, piece.PieceCid)
+	}
+	// Once tenant 2 runs out of pieces, the rest of tenant 1 follows
+	if expected := "a1 a2 b1 a3 a4 a5 b2 a6 a7"; strings.Join(order, " ") != expected {
+		t.Fatalf("ordered %s, expected %s", strings.Join(order, " "), expected)
+	}
+}
@@ -7,47 +7,130 @@ import (
 	"filecoin-spade-client/pkg/config"
 	"filecoin-spade-client/pkg/log"
 	"filecoin-spade-client/pkg/lotusclient"
+	"filecoin-spade-client/pkg/state"
 	"fmt"
+	"github.com/dustin/go-humanize"
 	fildatasegment "github.com/ribasushi/fil-datasegment/pkg/dlass"
 	"golang.org/x/xerrors"
 	"io"
+	"math"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 )
 
+const requestedPiecesBucket = "requested_pieces"
+
 type SpadeClient struct {
 	Config        config.SpadeConfig
 	LotusClient   *lotusclient.LotusClient
+	Store         *state.Store
 	HttpTransport http.RoundTripper
+	Selector      PieceSelector
+	Prober        *SourceProber // nil when sources aren't probed
 
 	LatestEligiblePiecesRequest       EligiblePiecesResponseEnvelope
 	LatestEligiblePiecesRequestMoment time.Time
 
-	requestedPieces      []string
+	requestedPieces      map[string]time.Time // when we requested the piece
 	requestedPiecesMutex sync.Mutex
 }
 
-func New(config config.Configuration, client *lotusclient.LotusClient) *SpadeClient {
+func New(config config.Configuration, client *lotusclient.LotusClient, store *state.Store) *SpadeClient {
 	sc := new(SpadeClient)
 	sc.Config = config.SpadeConfig
 	sc.LotusClient = client
+	sc.Store = store
 	sc.HttpTransport = &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
 	}
 	sc.LatestEligiblePiecesRequestMoment = time.Now().Add(-time.Hour)
+	sc.requestedPieces = make(map[string]time.Time)
+
+	selector, err := NewPieceSelector(config.SpadeConfig.PieceSelection, config.SpadeConfig.TenantWeights)
+	if err != nil {
+		log.Fatalf("error creating spade client: %+v", err)
+	}
+	sc.Selector = selector
+	if config.SpadeConfig.ProbeSources {
+		sc.Prober = NewSourceProber(config)
+	}
 	return sc
 }
 
 func (sc *SpadeClient) AddRequestedPiece(pieceCid string) {
+	now := time.Now()
 	sc.requestedPiecesMutex.Lock()
-	sc.requestedPieces = append(sc.requestedPieces, pieceCid)
+	sc.requestedPieces[pieceCid] = now
 	sc.requestedPiecesMutex.Unlock()
+
+	err := sc.Store.Put(requestedPiecesBucket, pieceCid, now)
+	if err != nil {
+		log.Warnf("Could not persist requested piece %s: %s", pieceCid, err)
+	}
+}
+
+func (sc *SpadeClient) loadRequestedPieces() error {
+	sc.requestedPiecesMutex.Lock()
+	defer sc.requestedPiecesMutex.Unlock()
+
+	sc.requestedPieces = make(map[string]time.Time)
+	return sc.Store.View(func(tx *state.Tx) error {
+		for _, pieceCid := range tx.Keys(requestedPiecesBucket) {
+			var requestedAt time.Time
+			if _, err := tx.Get(requestedPiecesBucket, pieceCid, &requestedAt); err != nil {
+				return err
+			}
+			sc.requestedPieces[pieceCid] = requestedAt
+		}
+		return nil
+	})
+}
+
+// ExpireRequestedPieces forgets the pieces we requested longer than the requested piece TTL ago, so they can be
+// requested again once their reservation failed or expired. It returns the expired pieces.
+func (sc *SpadeClient) ExpireRequestedPieces() []string {
+	if sc.Config.RequestedPieceTTL <= 0 {
+		return nil
+	}
+
+	var expired []string
+	sc.requestedPiecesMutex.Lock()
+	for pieceCid, requestedAt := range sc.requestedPieces {
+		if time.Since(requestedAt) > sc.Config.RequestedPieceTTL {
+			expired = append(expired, pieceCid)
+			delete(sc.requestedPieces, pieceCid)
+		}
+	}
+	sc.requestedPiecesMutex.Unlock()
+	if len(expired) == 0 {
+		return nil
+	}
+
+	err := sc.Store.Update(func(tx *state.Tx) error {
+		for _, pieceCid := range expired {
+			if err := tx.Delete(requestedPiecesBucket, pieceCid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Could not remove %d expired requested pieces from state: %s", len(expired), err)
+	}
+	log.Infof(" > %d requested pieces expired, they can be requested again", len(expired))
+	return expired
 }
 
 func (sc *SpadeClient) Start(ctx context.Context) {
-	_, err := sc.PendingProposals(ctx)
+	err := sc.loadRequestedPieces()
+	if err != nil {
+		log.Fatalf("error loading requested pieces: %+v", err)
+	}
+	log.Infof("Loaded %d previously requested pieces", len(sc.requestedPieces))
+
+	_, err = sc.PendingProposals(ctx)
 	if err != nil {
 		log.Fatalf("error starting spade client: %+v", err)
 	}
@@ -78,13 +161,14 @@ func (sc *SpadeClient) PendingProposals(ctx context.Context) (*ResponsePendingPr
 	return &resp.Response, nil
 }
 
-func (sc *SpadeClient) RequestNewDeal(ctx context.Context) (string, error) {
+// RequestNewDeal reserves an eligible piece we haven't requested before, of at most maxSize bytes (padded)
+func (sc *SpadeClient) RequestNewDeal(ctx context.Context, maxSize uint64) (*Piece, error) {
 	// We add some cache to this request because this can happen often
 	cached := true                                                          // small display hack
 	if time.Now().Unix()-sc.LatestEligiblePiecesRequestMoment.Unix() > 10 { // 10 second cache
 		data, err := sc.doRequest(ctx, "GET", "/sp/eligible_pieces", "")
 		if err != nil {
-			return "", xerrors.Errorf("error checking eligible pieces: %+v", err)
+			return nil, xerrors.Errorf("error checking eligible pieces: %+v", err)
 		}
 
 		//log.Debugf("PENDING RESPONSE: %s", data)
@@ -92,7 +176,7 @@ func (sc *SpadeClient) RequestNewDeal(ctx context.Context) (string, error) {
 		sc.LatestEligiblePiecesRequestMoment = time.Now()
 		err = json.Unmarshal(data, &sc.LatestEligiblePiecesRequest)
 		if err != nil {
-			return "", xerrors.Errorf("could not unmarshall response: %+v", err)
+			return nil, xerrors.Errorf("could not unmarshall response: %+v", err)
 		}
 		cached = false
 	}
@@ -103,7 +187,7 @@ func (sc *SpadeClient) RequestNewDeal(ctx context.Context) (string, error) {
 		if !cached {
 			log.Infof(" > No eligible pieces at the moment.")
 		}
-		return "", nil
+		return nil, nil
 	}
 
 	if !cached {
@@ -111,26 +195,97 @@ func (sc *SpadeClient) RequestNewDeal(ctx context.Context) (string, error) {
 	}
 
 	// find one that we do not already have requested
-	for _, piece := range resp.Response {
-		if !sc.hasRequestedPiece(piece.PieceCid) {
-			log.Infof("  > Requesting %s", piece.PieceCid)
-
-			_, err := sc.invoke(ctx, piece.PieceCid, piece.TenantPolicyCid)
-			if err != nil {
-				if err.Error() == "ErrTooManyReplicas" {
-					// If its "overreplicated" we can just add the piece to our requested pieces - we'll ignore it next run
-					sc.AddRequestedPiece(piece.PieceCid)
+	tooLarge := 0
+	wrongSize := 0
+	unreachable := 0
+	unprobed := 0
+	probeCtx := ctx
+	if sc.Prober != nil && sc.Config.ProbeBudget > 0 {
+		// Dead sources take the full probe timeout, don't hold up the scan for too long
+		var cancel context.CancelFunc
+		probeCtx, cancel = context.WithTimeout(ctx, sc.Config.ProbeBudget)
+		defer cancel()
+	}
+	minPieceSize, maxPieceSize := sc.pieceSizeRange()
+	tenantReasons := make(map[string]int)
+	for _, piece := range sc.Selector.Order(resp.Response) {
+		if sc.hasRequestedPiece(piece.PieceCid) {
+			continue
+		}
+		if piece.PaddedPieceSize > maxSize {
+			tooLarge++
+			continue
+		}
+		if piece.PaddedPieceSize < minPieceSize || piece.PaddedPieceSize > maxPieceSize {
+			wrongSize++
+			continue
+		}
+		tenant, reason := sc.selectTenant(piece)
+		if reason != "" {
+			tenantReasons[reason]++
+			continue
+		}
+		if sc.Prober != nil {
+			if ok, reason := sc.Prober.Reachable(probeCtx, piece); !ok {
+				if probeCtx.Err() != nil && ctx.Err() == nil {
+					// Out of probe budget, only pieces with a remembered result can still be reserved
+					unprobed++
+					continue
 				}
-				return "", xerrors.Errorf("   > Could not invoke reservation %s: %s", piece.PieceCid, err)
+				log.Debugf("  > Skipping %s: %s", piece.PieceCid, reason)
+				unreachable++
+				continue
 			}
+		}
 
-			sc.AddRequestedPiece(piece.PieceCid)
-			log.Infof("   > Successfully requested %s", piece.PieceCid)
-			return piece.PieceCid, nil
+		log.Infof("  > Requesting %s", piece.PieceCid)
+
+		_, err := sc.invoke(ctx, piece.PieceCid, piece.TenantPolicyCid)
+		if err != nil {
+			if err.Error() == "ErrTooManyReplicas" {
+				// If its "overreplicated" we can just add the piece to our requested pieces - we'll ignore it next run
+				sc.AddRequestedPiece(piece.PieceCid)
+			}
+			return nil, xerrors.Errorf("   > Could not invoke reservation %s: %s", piece.PieceCid, err)
 		}
+
+		sc.AddRequestedPiece(piece.PieceCid)
+		sc.recordTenantReservation(piece, tenant)
+		sc.Selector.Reserved(piece, tenant)
+		log.Infof("   > Successfully requested %s for tenant %d", piece.PieceCid, tenant)
+		return piece, nil
 	}
 
-	return "", xerrors.New(" > no eligible pieces are valid to be requested")
+	for reason, count := range tenantReasons {
+		log.Infof(" > Skipped %d eligible pieces: %s", count, reason)
+	}
+	if unreachable > 0 {
+		log.Infof(" > Skipped %d eligible pieces without a reachable source", unreachable)
+	}
+	if unprobed > 0 {
+		log.Infof(" > Skipped %d eligible pieces that could not be probed within %s, they are probed on a next scan", unprobed, sc.Config.ProbeBudget)
+	}
+	if wrongSize > 0 {
+		log.Infof(" > Skipped %d eligible pieces outside of the accepted piece sizes (%s - %s)", wrongSize, humanize.IBytes(minPieceSize), humanize.IBytes(maxPieceSize))
+	}
+
+	if tooLarge > 0 {
+		return nil, xerrors.Errorf(" > no eligible pieces are valid to be requested, %d pieces are larger than the %d bytes we have room for", tooLarge, maxSize)
+	}
+	return nil, xerrors.New(" > no eligible pieces are valid to be requested")
+}
+
+// pieceSizeRange returns the smallest and largest padded piece size we accept. Pieces never exceed our sector size.
+func (sc *SpadeClient) pieceSizeRange() (uint64, uint64) {
+	sectorSize := uint64(sc.LotusClient.SectorSize)
+	maxPieceSize := sc.Config.MaxPieceSize
+	if maxPieceSize == 0 || (sectorSize > 0 && maxPieceSize > sectorSize) {
+		maxPieceSize = sectorSize
+	}
+	if maxPieceSize == 0 {
+		maxPieceSize = math.MaxUint64
+	}
+	return sc.Config.MinPieceSize, maxPieceSize
 }
 
 func (sc *SpadeClient) invoke(ctx context.Context, pid string, policycid string) (*ResponseInvoke, error) {
@@ -184,12 +339,8 @@ func (sc *SpadeClient) RequestPieceManifest(ctx context.Context, proposalId stri
 func (sc *SpadeClient) hasRequestedPiece(pid string) bool {
 	sc.requestedPiecesMutex.Lock()
 	defer sc.requestedPiecesMutex.Unlock()
-	for _, v := range sc.requestedPieces {
-		if v == pid {
-			return true
-		}
-	}
-	return false
+	_, ok := sc.requestedPieces[pid]
+	return ok
 }
 
 func (sc *SpadeClient) doRequest(ctx context.Context, method string, url string, authPrefix string) ([]byte, error) {
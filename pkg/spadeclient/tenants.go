@@ -0,0 +1,135 @@
+package spadeclient
+
+import (
+	"encoding/json"
+	"filecoin-spade-client/pkg/log"
+	"filecoin-spade-client/pkg/state"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"time"
+)
+
+const (
+	tenantReservationsBucket = "tenant_reservations"
+
+	day  = 24 * time.Hour
+	week = 7 * day
+)
+
+// TenantReservation is a reserved piece accounted to a tenant's quota
+type TenantReservation struct {
+	TenantID int16     `json:"tenant_id"`
+	Bytes    uint64    `json:"bytes"`
+	At       time.Time `json:"at"`
+}
+
+func (sc *SpadeClient) isTenantAllowed(tenant int16) bool {
+	for _, denied := range sc.Config.DeniedTenants {
+		if denied == tenant {
+			return false
+		}
+	}
+	if len(sc.Config.AllowedTenants) == 0 {
+		return true
+	}
+	for _, allowed := range sc.Config.AllowedTenants {
+		if allowed == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// selectTenant returns the first tenant claiming the piece that we accept and that has room left in its quota.
+// When there is none, the reason is returned instead.
+func (sc *SpadeClient) selectTenant(piece *Piece) (int16, string) {
+	reason := "no claiming tenants"
+	for _, tenant := range piece.ClaimingTenants {
+		if !sc.isTenantAllowed(tenant) {
+			reason = fmt.Sprintf("tenant %d is not allowed", tenant)
+			continue
+		}
+
+		quota, ok := sc.Config.TenantQuotas[tenant]
+		if !ok {
+			return tenant, ""
+		}
+
+		if quota.DailyBytes > 0 {
+			if used := sc.tenantUsage(tenant, day); used+piece.PaddedPieceSize > quota.DailyBytes {
+				reason = fmt.Sprintf("tenant %d used %s of its daily quota of %s", tenant, humanize.IBytes(used), humanize.IBytes(quota.DailyBytes))
+				continue
+			}
+		}
+		if quota.WeeklyBytes > 0 {
+			if used := sc.tenantUsage(tenant, week); used+piece.PaddedPieceSize > quota.WeeklyBytes {
+				reason = fmt.Sprintf("tenant %d used %s of its weekly quota of %s", tenant, humanize.IBytes(used), humanize.IBytes(quota.WeeklyBytes))
+				continue
+			}
+		}
+		return tenant, ""
+	}
+	return 0, reason
+}
+
+// tenantUsage returns how many bytes we reserved for the tenant in the given period
+func (sc *SpadeClient) tenantUsage(tenant int16, period time.Duration) uint64 {
+	return sc.reservedBytes(period, func(reservation TenantReservation) bool {
+		return reservation.TenantID == tenant
+	})
+}
+
+// ReservedBytes returns how many bytes we reserved in the given period (up to a week), for all tenants
+func (sc *SpadeClient) ReservedBytes(period time.Duration) uint64 {
+	return sc.reservedBytes(period, func(reservation TenantReservation) bool {
+		return true
+	})
+}
+
+func (sc *SpadeClient) reservedBytes(period time.Duration, include func(reservation TenantReservation) bool) uint64 {
+	since := time.Now().Add(-period)
+	used := uint64(0)
+	err := sc.Store.ForEach(tenantReservationsBucket, func(key string, value json.RawMessage) error {
+		var reservation TenantReservation
+		if err := json.Unmarshal(value, &reservation); err != nil {
+			return err
+		}
+		if reservation.At.After(since) && include(reservation) {
+			used += reservation.Bytes
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Could not read reservations: %s", err)
+	}
+	return used
+}
+
+// recordTenantReservation accounts a reserved piece to the tenant, and forgets reservations older than a week
+func (sc *SpadeClient) recordTenantReservation(piece *Piece, tenant int16) {
+	err := sc.Store.Update(func(tx *state.Tx) error {
+		err := tx.Put(tenantReservationsBucket, piece.PieceCid, TenantReservation{
+			TenantID: tenant,
+			Bytes:    piece.PaddedPieceSize,
+			At:       time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+
+		expired := time.Now().Add(-week)
+		return tx.ForEach(tenantReservationsBucket, func(key string, value json.RawMessage) error {
+			var reservation TenantReservation
+			if err := json.Unmarshal(value, &reservation); err != nil {
+				return err
+			}
+			if reservation.At.Before(expired) {
+				return tx.Delete(tenantReservationsBucket, key)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Warnf("Could not record reservation of %s for tenant %d: %s", piece.PieceCid, tenant, err)
+	}
+}
@@ -0,0 +1,278 @@
+package state
+
+import (
+	"encoding/json"
+	"filecoin-spade-client/pkg/log"
+	"golang.org/x/xerrors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const stateFilename = "state.json"
+
+// Store is a small embedded key/value store, grouped in buckets, that is persisted as a single file.
+// Every committed transaction rewrites the file through a temporary file and an atomic rename, so a crash
+// either leaves the previous or the new state on disk, never a half-written one.
+type Store struct {
+	path    string
+	mutex   sync.Mutex
+	buckets map[string]map[string]json.RawMessage
+}
+
+func New(directory string) *Store {
+	s := new(Store)
+	s.path = filepath.Join(directory, stateFilename)
+	s.buckets = make(map[string]map[string]json.RawMessage)
+	return s
+}
+
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Load reads the state file from disk, creating the state directory when it doesn't exist yet
+func (s *Store) Load() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := os.MkdirAll(filepath.Dir(s.path), 0o755)
+	if err != nil {
+		return xerrors.Errorf("could not create state directory: %+v", err)
+	}
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		log.Infof("No state found at %s, starting with an empty state", s.path)
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("could not read state file: %+v", err)
+	}
+
+	buckets := make(map[string]map[string]json.RawMessage)
+	err = json.Unmarshal(data, &buckets)
+	if err != nil {
+		return xerrors.Errorf("could not unmarshall state file %s: %+v", s.path, err)
+	}
+	s.buckets = buckets
+
+	log.Infof("Loaded state from %s", s.path)
+	return nil
+}
+
+// Update runs fn in a writable transaction. When fn returns an error nothing is changed, otherwise the
+// changes are written to disk before Update returns.
+func (s *Store) Update(fn func(tx *Tx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx := newTx(s.buckets, true)
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	if len(tx.changes) == 0 {
+		return nil
+	}
+
+	buckets := tx.apply()
+	err = s.write(buckets)
+	if err != nil {
+		return err
+	}
+	s.buckets = buckets
+	return nil
+}
+
+// View runs fn in a read-only transaction
+func (s *Store) View(fn func(tx *Tx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return fn(newTx(s.buckets, false))
+}
+
+func (s *Store) Put(bucket string, key string, value interface{}) error {
+	return s.Update(func(tx *Tx) error {
+		return tx.Put(bucket, key, value)
+	})
+}
+
+func (s *Store) Get(bucket string, key string, value interface{}) (bool, error) {
+	found := false
+	err := s.View(func(tx *Tx) error {
+		var err error
+		found, err = tx.Get(bucket, key, value)
+		return err
+	})
+	return found, err
+}
+
+func (s *Store) Delete(bucket string, key string) error {
+	return s.Update(func(tx *Tx) error {
+		return tx.Delete(bucket, key)
+	})
+}
+
+func (s *Store) ForEach(bucket string, fn func(key string, value json.RawMessage) error) error {
+	return s.View(func(tx *Tx) error {
+		return tx.ForEach(bucket, fn)
+	})
+}
+
+func (s *Store) write(buckets map[string]map[string]json.RawMessage) error {
+	data, err := json.Marshal(buckets)
+	if err != nil {
+		return xerrors.Errorf("could not serialize state: %+v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), stateFilename+".*.tmp")
+	if err != nil {
+		return xerrors.Errorf("could not create temporary state file: %+v", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after the rename succeeded
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return xerrors.Errorf("could not write temporary state file: %+v", err)
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return xerrors.Errorf("could not replace state file: %+v", err)
+	}
+	return nil
+}
+
+// Tx is a view on the store; writes are buffered until the transaction is committed by Store.Update
+type Tx struct {
+	buckets  map[string]map[string]json.RawMessage
+	changes  map[string]map[string]json.RawMessage // a nil value marks a deletion
+	writable bool
+}
+
+func newTx(buckets map[string]map[string]json.RawMessage, writable bool) *Tx {
+	tx := new(Tx)
+	tx.buckets = buckets
+	tx.changes = make(map[string]map[string]json.RawMessage)
+	tx.writable = writable
+	return tx
+}
+
+func (tx *Tx) Put(bucket string, key string, value interface{}) error {
+	if !tx.writable {
+		return xerrors.New("cannot write in a read-only transaction")
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return xerrors.Errorf("could not serialize %s/%s: %+v", bucket, key, err)
+	}
+
+	tx.change(bucket, key, data)
+	return nil
+}
+
+func (tx *Tx) Delete(bucket string, key string) error {
+	if !tx.writable {
+		return xerrors.New("cannot write in a read-only transaction")
+	}
+
+	tx.change(bucket, key, nil)
+	return nil
+}
+
+func (tx *Tx) Get(bucket string, key string, value interface{}) (bool, error) {
+	data, ok := tx.raw(bucket, key)
+	if !ok {
+		return false, nil
+	}
+
+	err := json.Unmarshal(data, value)
+	if err != nil {
+		return true, xerrors.Errorf("could not unmarshall %s/%s: %+v", bucket, key, err)
+	}
+	return true, nil
+}
+
+// Keys returns the keys of a bucket in sorted order
+func (tx *Tx) Keys(bucket string) []string {
+	var keys []string
+	for key := range tx.buckets[bucket] {
+		if _, changed := tx.changes[bucket][key]; !changed {
+			keys = append(keys, key)
+		}
+	}
+	for key, value := range tx.changes[bucket] {
+		if value != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (tx *Tx) ForEach(bucket string, fn func(key string, value json.RawMessage) error) error {
+	for _, key := range tx.Keys(bucket) {
+		value, _ := tx.raw(bucket, key)
+		err := fn(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *Tx) raw(bucket string, key string) (json.RawMessage, bool) {
+	if changes, ok := tx.changes[bucket]; ok {
+		if value, ok := changes[key]; ok {
+			return value, value != nil
+		}
+	}
+	value, ok := tx.buckets[bucket][key]
+	return value, ok
+}
+
+func (tx *Tx) change(bucket string, key string, value json.RawMessage) {
+	if _, ok := tx.changes[bucket]; !ok {
+		tx.changes[bucket] = make(map[string]json.RawMessage)
+	}
+	tx.changes[bucket][key] = value
+}
+
+// apply returns a copy of the store's buckets with the changes of this transaction applied. Buckets that were
+// not touched are shared with the original, as their contents are never modified in place.
+func (tx *Tx) apply() map[string]map[string]json.RawMessage {
+	buckets := make(map[string]map[string]json.RawMessage, len(tx.buckets))
+	for name, bucket := range tx.buckets {
+		buckets[name] = bucket
+	}
+
+	for name, changes := range tx.changes {
+		bucket := make(map[string]json.RawMessage, len(tx.buckets[name])+len(changes))
+		for key, value := range tx.buckets[name] {
+			bucket[key] = value
+		}
+		for key, value := range changes {
+			if value == nil {
+				delete(bucket, key)
+			} else {
+				bucket[key] = value
+			}
+		}
+		if len(bucket) == 0 {
+			delete(buckets, name)
+		} else {
+			buckets[name] = bucket
+		}
+	}
+	return buckets
+}
@@ -0,0 +1,151 @@
+package state
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	failed := errors.New("failed")
+
+	tests := []struct {
+		name     string
+		fn       func(tx *Tx) error
+		err      error
+		expected map[string]string // the contents of bucket "b" afterwards
+	}{
+		{
+			name:     "commit",
+			fn:       func(tx *Tx) error { return tx.Put("b", "new", "value") },
+			expected: map[string]string{"a": "1", "b": "2", "new": "value"},
+		},
+		{
+			name: "commit a change and a deletion",
+			fn: func(tx *Tx) error {
+				if err := tx.Put("b", "a", "changed"); err != nil {
+					return err
+				}
+				return tx.Delete("b", "b")
+			},
+			expected: map[string]string{"a": "changed"},
+		},
+		{
+			name: "roll back puts when fn fails",
+			fn: func(tx *Tx) error {
+				if err := tx.Put("b", "new", "value"); err != nil {
+					return err
+				}
+				return failed
+			},
+			err:      failed,
+			expected: map[string]string{"a": "1", "b": "2"},
+		},
+		{
+			name: "roll back changes and deletions when fn fails",
+			fn: func(tx *Tx) error {
+				if err := tx.Put("b", "a", "changed"); err != nil {
+					return err
+				}
+				if err := tx.Delete("b", "b"); err != nil {
+					return err
+				}
+				return failed
+			},
+			err:      failed,
+			expected: map[string]string{"a": "1", "b": "2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory := t.TempDir()
+			s := New(directory)
+			if err := s.Load(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put("b", "a", "1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put("b", "b", "2"); err != nil {
+				t.Fatal(err)
+			}
+
+			err := s.Update(test.fn)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Update returned %v, expected %v", err, test.err)
+			}
+			expectBucket(t, s, test.expected)
+
+			// What's on disk matches what's in memory
+			reloaded := New(directory)
+			if err := reloaded.Load(); err != nil {
+				t.Fatal(err)
+			}
+			expectBucket(t, reloaded, test.expected)
+		})
+	}
+}
+
+func TestTxSeesOwnWrites(t *testing.T) {
+	s := New(t.TempDir())
+	if err := s.Put("b", "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.Update(func(tx *Tx) error {
+		if err := tx.Put("b", "c", "3"); err != nil {
+			return err
+		}
+		if err := tx.Delete("b", "a"); err != nil {
+			return err
+		}
+		if keys := tx.Keys("b"); len(keys) != 1 || keys[0] != "c" {
+			t.Errorf("keys %v within the transaction, expected [c]", keys)
+		}
+		var value string
+		if found, _ := tx.Get("b", "a", &value); found {
+			t.Errorf("deleted key found within the transaction")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestViewIsReadOnly(t *testing.T) {
+	s := New(t.TempDir())
+	err := s.View(func(tx *Tx) error {
+		return tx.Put("b", "a", "1")
+	})
+	if err == nil {
+		t.Fatal("expected an error writing in a read-only transaction")
+	}
+	expectBucket(t, s, map[string]string{})
+}
+
+func expectBucket(t *testing.T, s *Store, expected map[string]string) {
+	t.Helper()
+	actual := make(map[string]string)
+	err := s.View(func(tx *Tx) error {
+		for _, key := range tx.Keys("b") {
+			var value string
+			if _, err := tx.Get("b", key, &value); err != nil {
+				return err
+			}
+			actual[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("bucket contains %v, expected %v", actual, expected)
+	}
+	for key, value := range expected {
+		if actual[key] != value {
+			t.Fatalf("bucket contains %v, expected %v", actual, expected)
+		}
+	}
+}